@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Supported ssh authentication methods, see Server.Auth.
+const (
+	authAgent               = "agent"
+	authKey                 = "key"
+	authPassword            = "password"
+	authKeyboardInteractive = "keyboard-interactive"
+)
+
+var defaultAuths = []string{authAgent, authKey, authPassword, authKeyboardInteractive}
+
+// authMethods returns authentication methods in the order of Server.Auth.
+// As ssh tries every method once, keys from ssh-agent and key files are
+// combined into one publickey method, placed at the first of them.
+func (s *Server) authMethods() []ssh.AuthMethod {
+	auths := s.Auth
+	if len(auths) == 0 {
+		auths = defaultAuths
+	}
+
+	var methods []ssh.AuthMethod
+	var signers []ssh.Signer
+	pubkeyIndex := -1
+	for _, auth := range auths {
+		switch auth {
+		case authAgent:
+			signers = append(signers, s.agentSigners(len(s.Auth) > 0)...)
+		case authKey:
+			signers = append(signers, s.keySigners()...)
+		case authPassword:
+			if s.Auth != nil || s.hasPassword() || isTerminal() {
+				methods = append(methods, ssh.PasswordCallback(s.password))
+			}
+			continue
+		case authKeyboardInteractive:
+			if s.Auth != nil || s.hasPassword() || isTerminal() {
+				methods = append(methods, ssh.KeyboardInteractive(s.keyboardInteractive))
+			}
+			continue
+		default:
+			s.exitf("unknown auth method %q, supported: %s", auth, strings.Join(defaultAuths, ", "))
+		}
+		if pubkeyIndex < 0 {
+			pubkeyIndex = len(methods)
+			methods = append(methods, nil)
+		}
+	}
+
+	if pubkeyIndex >= 0 {
+		if len(signers) > 0 {
+			methods[pubkeyIndex] = ssh.PublicKeys(signers...)
+		} else {
+			methods = append(methods[:pubkeyIndex], methods[pubkeyIndex+1:]...)
+		}
+	}
+	if len(methods) == 0 {
+		s.exitf("no available ssh authentication method (Auth: %s)", strings.Join(auths, ", "))
+	}
+	return methods
+}
+
+var (
+	sshAgentOnce   sync.Once
+	sshAgentClient agent.Agent
+	sshAgentErr    error
+)
+
+// sshAgent returns the client of ssh-agent from SSH_AUTH_SOCK.
+func sshAgent() (agent.Agent, error) {
+	sshAgentOnce.Do(func() {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			sshAgentErr = errors.New("SSH_AUTH_SOCK is empty")
+			return
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			sshAgentErr = err
+			return
+		}
+		sshAgentClient = agent.NewClient(conn)
+	})
+	return sshAgentClient, sshAgentErr
+}
+
+// agentSigners returns keys in ssh-agent. An unavailable agent is only an
+// error when it's required by Server.Auth.
+func (s *Server) agentSigners(required bool) []ssh.Signer {
+	client, err := sshAgent()
+	if err != nil {
+		if required {
+			s.exitf("failed to connect ssh-agent: %s", err)
+		}
+		if option.debug {
+			log.Printf("[%s] ssh-agent is not available: %s\n", s, err)
+		}
+		return nil
+	}
+	signers, err := client.Signers()
+	if err != nil {
+		s.exitf("failed to retrieve signers: %s", err)
+	}
+	return signers
+}
+
+// keySigners returns keys from Key, KeyEnv (or HARP_SSH_KEY) and
+// IdentityFile in ssh config. Like OpenSSH, missing or unusable identity
+// files in ssh config are ignored, but errors of keys specified in
+// harp.json are not.
+func (s *Server) keySigners() []ssh.Signer {
+	var signers []ssh.Signer
+	if s.Key != "" {
+		path := expandHome(s.Key)
+		signer, err := loadKey(path, func() ([]byte, error) { return ioutil.ReadFile(path) }, s.PassphraseEnv)
+		if err != nil {
+			s.exitf("failed to load key %s: %s", s.Key, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	keyEnv := firstNonEmpty(s.KeyEnv, "HARP_SSH_KEY")
+	if pemData := os.Getenv(keyEnv); pemData != "" {
+		signer, err := loadKey("$"+keyEnv, func() ([]byte, error) { return []byte(pemData), nil }, s.PassphraseEnv)
+		if err != nil {
+			s.exitf("failed to load key from $%s: %s", keyEnv, err)
+		}
+		signers = append(signers, signer)
+	} else if s.KeyEnv != "" {
+		s.exitf("environment variable %s is empty", s.KeyEnv)
+	}
+
+	for _, file := range s.identityFiles {
+		if s.isKeyInAgent(file) {
+			// avoid asking for passphrase of keys already in ssh-agent
+			continue
+		}
+		signer, err := loadKey(file, func() ([]byte, error) { return ioutil.ReadFile(file) }, s.PassphraseEnv)
+		if err != nil {
+			if option.debug {
+				log.Printf("[%s] failed to load identity file %s: %s\n", s, file, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// isKeyInAgent reports whether the public key (path.pub) of key file is
+// loaded in ssh-agent.
+func (s *Server) isKeyInAgent(path string) bool {
+	client, err := sshAgent()
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(path + ".pub")
+	if err != nil {
+		return false
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return false
+	}
+	keys, err := client.List()
+	if err != nil {
+		return false
+	}
+	for _, key := range keys {
+		if bytes.Equal(key.Marshal(), pub.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+type loadedKey struct {
+	signer ssh.Signer
+	err    error
+}
+
+var (
+	keysMutex sync.Mutex
+	keysCache = map[string]*loadedKey{}
+	// keyring holds keys loaded by harp, served to rsync, see rsyncEnv.
+	keyring = agent.NewKeyring()
+)
+
+// loadKey loads and caches private key, so that passphrase is asked only once
+// for all servers.
+func loadKey(name string, read func() ([]byte, error), passphraseEnv string) (ssh.Signer, error) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	if key, ok := keysCache[name]; ok {
+		return key.signer, key.err
+	}
+
+	key := &loadedKey{}
+	keysCache[name] = key
+	data, err := read()
+	if err != nil {
+		key.err = err
+		return nil, err
+	}
+	raw, err := parsePrivateKey(data, func() ([]byte, error) {
+		env := firstNonEmpty(passphraseEnv, "HARP_SSH_PASSPHRASE")
+		if pass := os.Getenv(env); pass != "" {
+			return []byte(pass), nil
+		}
+		pass, err := promptSecret(fmt.Sprintf("Enter passphrase for key %s: ", name))
+		if err != nil {
+			return nil, fmt.Errorf("key is encrypted, passphrase is required (%s): %s", env, err)
+		}
+		return []byte(pass), nil
+	})
+	if err != nil {
+		key.err = err
+		return nil, err
+	}
+	if key.signer, key.err = ssh.NewSignerFromKey(raw); key.err != nil {
+		return nil, key.err
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: raw, Comment: name}); err != nil && option.debug {
+		log.Printf("failed to add key %s to harp agent: %s\n", name, err)
+	}
+	return key.signer, nil
+}
+
+// parsePrivateKey parses private keys in PEM or the OpenSSH format.
+// passphrase is called for encrypted keys.
+func parsePrivateKey(data []byte, passphrase func() ([]byte, error)) (interface{}, error) {
+	raw, err := ssh.ParseRawPrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return raw, err
+	}
+	pass, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParseRawPrivateKeyWithPassphrase(data, pass)
+}
+
+func (s *Server) hasPassword() bool {
+	return s.Password != "" || os.Getenv(firstNonEmpty(s.PasswordEnv, "HARP_SSH_PASSWORD")) != ""
+}
+
+var passwords = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// password returns Password, PasswordEnv (or HARP_SSH_PASSWORD), or asks
+// for it. Passwords are remembered for the same user@host, which are also
+// given to rsync, see askpassEnv.
+func (s *Server) password() (string, error) {
+	passwords.Lock()
+	defer passwords.Unlock()
+	id := s.User + "@" + s.addr()
+	if pass, ok := passwords.m[id]; ok {
+		return pass, nil
+	}
+	pass := os.Getenv(firstNonEmpty(s.PasswordEnv, "HARP_SSH_PASSWORD"))
+	if s.Password != "" {
+		pass = revealSecret(s.Password)
+	}
+	if pass == "" {
+		var err error
+		if pass, err = promptSecret(fmt.Sprintf("%s's password: ", id)); err != nil {
+			return "", err
+		}
+	}
+	passwords.m[id] = pass
+	return pass, nil
+}
+
+// keyboardInteractive answers password questions with password, and asks
+// user for the others.
+func (s *Server) keyboardInteractive(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	if instruction != "" && isTerminal() {
+		fmt.Fprintf(os.Stderr, "[%s] %s\n", s, instruction)
+	}
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		var err error
+		if !echos[i] && strings.Contains(strings.ToLower(q), "password") {
+			answers[i], err = s.password()
+		} else {
+			s.prompted = true
+			answers[i], err = promptSecret(fmt.Sprintf("[%s] %s", s, q))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return answers, nil
+}
+
+// promptMutex serializes prompts of servers connected concurrently.
+var promptMutex sync.Mutex
+
+// prompting counts prompts waiting for user input, connect timeout is paused
+// meanwhile.
+var prompting int32
+
+// isTerminal reports whether stdin is a terminal, replaced in tests.
+var isTerminal = func() bool { return terminal.IsTerminal(int(os.Stdin.Fd())) }
+
+// promptSecret reads a line from terminal without echo.
+func promptSecret(prompt string) (string, error) {
+	atomic.AddInt32(&prompting, 1)
+	defer atomic.AddInt32(&prompting, -1)
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+	if !isTerminal() {
+		return "", errors.New("stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	data, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(data), err
+}
+
+var (
+	harpAgentOnce sync.Once
+	harpAgentSock string
+)
+
+// rsyncEnv returns environment variables for rsync and ssh commands. If harp
+// has loaded keys from files, a local agent serving them (and keys of
+// ssh-agent) is started, so that ssh doesn't ask for passphrases again.
+func rsyncEnv() []string {
+	if keys, err := keyring.List(); err != nil || len(keys) == 0 {
+		return nil
+	}
+	harpAgentOnce.Do(func() {
+		sock := filepath.Join(runtimeDir(), "agent.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			exitf("failed to start harp agent: %s", err)
+		}
+		upstream, _ := sshAgent()
+		a := &harpAgent{Agent: keyring, upstream: upstream}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					agent.ServeAgent(a, conn)
+				}()
+			}
+		}()
+		harpAgentSock = sock
+	})
+	return []string{"SSH_AUTH_SOCK=" + harpAgentSock}
+}
+
+// harpAgent serves keys loaded by harp and forwards the others to ssh-agent.
+type harpAgent struct {
+	agent.Agent
+	upstream agent.Agent
+}
+
+func (a *harpAgent) List() ([]*agent.Key, error) {
+	keys, err := a.Agent.List()
+	if err != nil || a.upstream == nil {
+		return keys, err
+	}
+	upstreamKeys, err := a.upstream.List()
+	if err != nil {
+		return keys, nil
+	}
+	return append(keys, upstreamKeys...), nil
+}
+
+func (a *harpAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	sig, err := a.Agent.Sign(key, data)
+	if err != nil && a.upstream != nil {
+		return a.upstream.Sign(key, data)
+	}
+	return sig, err
+}
+
+// askpassScript answers password prompts of ssh started by rsync, with
+// passwords of servers in $HARP_ASKPASS_ID_n (user@host) and
+// $HARP_ASKPASS_PASSWORD_n. Other password prompts are answered by
+// $HARP_ASKPASS_DEFAULT, which is set if all servers share one password.
+const askpassScript = `#!/bin/sh
+i=0
+while [ $i -lt "$HARP_ASKPASS_COUNT" ]; do
+	eval "id=\$HARP_ASKPASS_ID_$i pass=\$HARP_ASKPASS_PASSWORD_$i"
+	case "$1" in
+	"$id's password: "*|*"($id)"*) printf '%s\n' "$pass"; exit 0 ;;
+	esac
+	i=$((i + 1))
+done
+case "$1" in
+*assword*) [ -n "${HARP_ASKPASS_DEFAULT+set}" ] && printf '%s\n' "$HARP_ASKPASS_DEFAULT" && exit 0 ;;
+esac
+exit 1
+`
+
+var (
+	askpassOnce sync.Once
+	askpassPath string
+)
+
+// askpassEnv returns environment variables for ssh started by rsync to
+// authenticate the server and its proxies by passwords used by harp, via
+// SSH_ASKPASS. ssh (OpenSSH 8.4+) uses it even with a terminal because of
+// SSH_ASKPASS_REQUIRE, and older ones use it without a terminal (e.g. CI).
+//
+// Passwords are passed in environment variables of rsync, which are not
+// written into disk.
+func (s *Server) askpassEnv() []string {
+	var env []string
+	distinct := map[string]bool{}
+	passwords.Lock()
+	for p := s; p != nil; p = p.Proxy {
+		pass, ok := passwords.m[p.User+"@"+p.addr()]
+		if !ok {
+			continue
+		}
+		distinct[pass] = true
+		hosts := []string{p.Host}
+		if p.hostname != "" && p.hostname != p.Host {
+			hosts = append(hosts, p.hostname)
+		}
+		for _, host := range hosts {
+			n := len(env) / 2
+			env = append(env,
+				fmt.Sprintf("HARP_ASKPASS_ID_%d=%s@%s", n, p.User, host),
+				fmt.Sprintf("HARP_ASKPASS_PASSWORD_%d=%s", n, pass),
+			)
+		}
+	}
+	passwords.Unlock()
+	if len(env) == 0 {
+		return nil
+	}
+
+	askpassOnce.Do(func() {
+		path := filepath.Join(runtimeDir(), "askpass")
+		if err := ioutil.WriteFile(path, []byte(askpassScript), 0700); err != nil {
+			exitf("failed to create askpass script: %s", err)
+		}
+		askpassPath = path
+	})
+	env = append(env,
+		fmt.Sprintf("HARP_ASKPASS_COUNT=%d", len(env)/2),
+		"SSH_ASKPASS="+askpassPath,
+		"SSH_ASKPASS_REQUIRE=force",
+	)
+	if len(distinct) == 1 {
+		// prompts without user@host (e.g. "Password:") are answered only
+		// when there is no doubt about the password
+		for pass := range distinct {
+			env = append(env, "HARP_ASKPASS_DEFAULT="+pass)
+		}
+	}
+	if os.Getenv("DISPLAY") == "" {
+		// required by ssh older than 8.4 to use SSH_ASKPASS
+		env = append(env, "DISPLAY=harp")
+	}
+	return env
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// buildTarget describes how a binary is compiled for a server. Servers share
+// the same binary when their targets are equal.
+type buildTarget struct {
+	GOOS, GOARCH string
+	BuildArgs    string
+	BuildTags    string
+}
+
+// buildTarget resolves build target of the server, with precedence:
+// server > server set > global config. Build args from command line flag
+// -build-args overrides all.
+func (s *Server) buildTarget() (t buildTarget) {
+	set := s.serverSet()
+
+	t.GOOS = firstNonEmpty(s.GOOS, set.GOOS, cfg.GOOS)
+	t.GOARCH = firstNonEmpty(s.GOARCH, set.GOARCH, cfg.GOARCH)
+	t.BuildArgs = firstNonEmpty(option.buildArgs, s.BuildArgs, set.BuildArgs, cfg.App.BuildArgs, "-a -v")
+	t.BuildTags = firstNonEmpty(s.BuildTags, set.BuildTags)
+
+	return
+}
+
+// platform returns a target without build args and tags, used for migrations.
+func (t buildTarget) platform() buildTarget {
+	return buildTarget{GOOS: t.GOOS, GOARCH: t.GOARCH}
+}
+
+func (t buildTarget) String() string {
+	str := t.GOOS + "/" + t.GOARCH
+	if t.BuildArgs != "" {
+		str += " " + t.BuildArgs
+	}
+	if t.BuildTags != "" {
+		str += " -tags " + t.BuildTags
+	}
+	return str
+}
+
+// dir returns the local directory where build outputs of the target are saved.
+func (t buildTarget) dir() string {
+	name := t.GOOS + "_" + t.GOARCH
+	if name == "_" {
+		name = "default"
+	}
+	if t.BuildArgs != "" || t.BuildTags != "" {
+		h := fnv.New32a()
+		h.Write([]byte(t.BuildArgs + "\x00" + t.BuildTags))
+		name += fmt.Sprintf("_%x", h.Sum32())
+	}
+	return filepath.Join(tmpDir, "builds", name)
+}
+
+// output returns the path of application binary built for the target.
+func (t buildTarget) output() string { return filepath.Join(t.dir(), cfg.App.Name) }
+
+func (t buildTarget) env() []string {
+	var env []string
+	if t.GOOS != "" {
+		env = append(env, "GOOS="+t.GOOS)
+	}
+	if t.GOARCH != "" {
+		env = append(env, "GOARCH="+t.GOARCH)
+	}
+	return env
+}
+
+// retrieveBuildTargets returns distinct build targets of servers. Only GOOS
+// and GOARCH are taken into account if platformOnly is true (for migrations).
+func retrieveBuildTargets(servers []*Server, platformOnly bool) []buildTarget {
+	var targets []buildTarget
+	existings := map[buildTarget]bool{}
+	for _, s := range servers {
+		t := s.buildTarget()
+		if platformOnly {
+			t = t.platform()
+		}
+		if existings[t] {
+			continue
+		}
+		existings[t] = true
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].String() < targets[j].String() })
+	return targets
+}
+
+// buildAll builds every target once and in parallel.
+func buildAll(targets []buildTarget) {
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t buildTarget) {
+			defer wg.Done()
+			if len(targets) > 1 {
+				log.Printf("building %s\n", t)
+			}
+			build(t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+func build(t buildTarget) {
+	app := cfg.App
+
+	cmd("mkdir", "-p", t.dir())
+	boutput := t.output()
+	ba := t.BuildArgs
+	if t.BuildTags != "" {
+		ba += fmt.Sprintf(" -tags '%s'", t.BuildTags)
+	}
+	ldflags := currentBuildInfo().withTarget(t).ldflags()
+	if ldflags != "" {
+		var err error
+		if ba, err = mergeLdflags(ba, ldflags); err != nil {
+			exitf("failed to inject build info: %s", err)
+		}
+	}
+	buildCmd := fmt.Sprintf("go build %s -o %s %s", ba, boutput, app.ImportPath)
+	if app.BuildCmd != "" {
+		buildCmd = fmt.Sprintf(app.BuildCmd, boutput, app.ImportPath)
+	}
+	if option.debug {
+		println("build cmd:", buildCmd)
+	}
+	// HARP_LDFLAGS is exported for BuildCmd to inject build info.
+	output := cmdEnv(append(t.env(), "HARP_LDFLAGS="+ldflags), "sh", "-c", buildCmd)
+	if option.debug {
+		print(output)
+	}
+}
+
+// mergeLdflags appends ldflags of build info to build args. As go build
+// only takes the last -ldflags, -ldflags in build args are merged after the
+// injected ones, so that user flags (e.g. -s -w, -X) are kept and win.
+func mergeLdflags(buildArgs, ldflags string) (string, error) {
+	args, err := shellSplit(buildArgs)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	var found bool
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := "-" + strings.TrimLeft(arg, "-")
+		switch {
+		case name == "-ldflags":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("flag needs an argument: %s", arg)
+			}
+			i++
+			ldflags += " " + args[i]
+		case strings.HasPrefix(name, "-ldflags="):
+			ldflags += " " + strings.TrimPrefix(name, "-ldflags=")
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return strings.TrimSpace(buildArgs + " -ldflags " + shellQuote(ldflags)), nil
+	}
+	return strings.TrimSpace(shellJoin(rest) + " -ldflags " + shellQuote(ldflags)), nil
+}
+
+func firstNonEmpty(strs ...string) string {
+	for _, str := range strs {
+		if str != "" {
+			return str
+		}
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestRetrieveBuildTargets(t *testing.T) {
+	cfg = Config{GOOS: "linux", GOARCH: "amd64"}
+	cfg.ServerSets = map[string]*ServerSet{
+		"arm": {GOARCH: "arm64", BuildTags: "netgo"},
+	}
+	servers := []*Server{
+		{Host: "a", Set: "prod"},
+		{Host: "b", Set: "prod", GOARCH: "arm64", BuildTags: "netgo"},
+		{Host: "c", Set: "arm"},
+		{Host: "d", Set: "arm", BuildTags: "osusergo"},
+	}
+
+	targets := retrieveBuildTargets(servers, false)
+	if len(targets) != 3 {
+		t.Fatalf("expect 3 targets got %d: %+v", len(targets), targets)
+	}
+	if got := servers[1].buildTarget(); got != servers[2].buildTarget() {
+		t.Errorf("expect servers b and c sharing the same target, got %s and %s", got, servers[2].buildTarget())
+	}
+	if got, want := servers[3].buildTarget().String(), "linux/arm64 -a -v -tags osusergo"; got != want {
+		t.Errorf("expect %q got %q", want, got)
+	}
+
+	if platforms := retrieveBuildTargets(servers, true); len(platforms) != 2 {
+		t.Errorf("expect 2 platforms got %d: %+v", len(platforms), platforms)
+	}
+}
+
+func TestMergeLdflags(t *testing.T) {
+	const ldflags = "-X main.harpVersion=1"
+	for args, want := range map[string]string{
+		"":                                  `-ldflags '-X main.harpVersion=1'`,
+		"-a -v":                             `-a -v -ldflags '-X main.harpVersion=1'`,
+		"-ldflags '-s -w' -v":               `-v -ldflags '-X main.harpVersion=1 -s -w'`,
+		`-a --ldflags="-X 'main.Name=a b'"`: `-a -ldflags '-X main.harpVersion=1 -X '\''main.Name=a b'\'''`,
+		"-ldflags=-s -ldflags -w":           `-ldflags '-X main.harpVersion=1 -s -w'`,
+	} {
+		if got, err := mergeLdflags(args, ldflags); err != nil || got != want {
+			t.Errorf("mergeLdflags(%q) = %s, %v; want %s", args, got, err, want)
+		}
+	}
+	for _, args := range []string{"-v -ldflags", "-ldflags '-s"} {
+		if _, err := mergeLdflags(args, ldflags); err == nil {
+			t.Errorf("mergeLdflags(%q) succeeds", args)
+		}
+	}
+}
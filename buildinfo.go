@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// BuildInfo describes a deployment. It's saved in harp-build.info as json
+// on servers, and is injected into application binaries by -ldflags -X when
+// App.BuildInfoVar is specified.
+type BuildInfo struct {
+	GoVersion string `json:",omitempty"`
+	GOOS      string `json:",omitempty"`
+	GOARCH    string `json:",omitempty"`
+	BuildArgs string `json:",omitempty"`
+	BuildTags string `json:",omitempty"`
+
+	VCS         string `json:",omitempty"`
+	Checksum    string `json:",omitempty"`
+	Composer    string
+	BuildAt     time.Time
+	HarpVersion string
+	ReleaseID   string `json:",omitempty"`
+}
+
+const harpVersionPrefix = "Harp Version: "
+
+var buildInfoOnce sync.Once
+var buildInfo BuildInfo
+
+// currentBuildInfo returns build info shared by all the builds of the current
+// harp command.
+func currentBuildInfo() BuildInfo {
+	buildInfoOnce.Do(func() {
+		// go version go1.4.2 darwin/amd64
+		if fields := strings.Fields(cmd("go", "version")); len(fields) > 2 {
+			buildInfo.GoVersion = fields[2]
+		}
+		buildInfo.VCS, buildInfo.Checksum = retrieveChecksum()
+		buildInfo.Composer = retrieveAuthor()
+		buildInfo.BuildAt = time.Now()
+		buildInfo.HarpVersion = getVersion()
+		if rollbackEnabled() {
+			buildInfo.ReleaseID = releaseID()
+		}
+	})
+	return buildInfo
+}
+
+func (bi BuildInfo) withTarget(t buildTarget) BuildInfo {
+	bi.GOOS = t.GOOS
+	bi.GOARCH = t.GOARCH
+	bi.BuildArgs = t.BuildArgs
+	bi.BuildTags = t.BuildTags
+	return bi
+}
+
+// marshal returns content of harp-build.info.
+func (bi BuildInfo) marshal() string {
+	data, err := json.MarshalIndent(bi, "", "\t")
+	if err != nil {
+		exitf("failed to marshal build info: %s", err)
+	}
+	return string(data)
+}
+
+// ldflags returns linker flags setting App.BuildInfoVar. Single quotes are
+// escaped in json so that the value could be quoted by single quotes, which
+// is supported by go build for splitting -ldflags.
+func (bi BuildInfo) ldflags() string {
+	if cfg.App.BuildInfoVar == "" {
+		return ""
+	}
+	data, err := json.Marshal(bi)
+	if err != nil {
+		exitf("failed to marshal build info: %s", err)
+	}
+	value := strings.Replace(string(data), "'", `\u0027`, -1)
+	return fmt.Sprintf("-X '%s=%s'", cfg.App.BuildInfoVar, value)
+}
+
+// String renders build info in the text format used before harp-build.info
+// is saved as json.
+func (bi BuildInfo) String() string {
+	var str string
+	if bi.GoVersion != "" {
+		str += "Go Version: " + bi.GoVersion + "\n"
+	}
+	if bi.GOOS != "" {
+		str += "GOOS: " + bi.GOOS + "\n"
+	}
+	if bi.GOARCH != "" {
+		str += "GOARCH: " + bi.GOARCH + "\n"
+	}
+	if bi.BuildArgs != "" {
+		str += "Build Args: " + bi.BuildArgs + "\n"
+	}
+	if bi.BuildTags != "" {
+		str += "Build Tags: " + bi.BuildTags + "\n"
+	}
+	str += harpVersionPrefix + bi.HarpVersion + "\n"
+	if bi.Checksum != "" {
+		str += bi.VCS + " Checksum: " + bi.Checksum + "\n"
+	}
+	str += "Composer: " + bi.Composer + "\n"
+	if bi.ReleaseID != "" {
+		str += "Release ID: " + bi.ReleaseID + "\n"
+	}
+	str += "Build At: " + bi.BuildAt.String() + "\n"
+	return str
+}
+
+// parseBuildInfo parses harp-build.info. Both json and the older text format
+// are supported.
+func parseBuildInfo(data string) (bi BuildInfo, err error) {
+	data = strings.TrimSpace(data)
+	if strings.HasPrefix(data, "{") {
+		err = json.Unmarshal([]byte(data), &bi)
+		return
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := kv[0], strings.TrimSpace(kv[1])
+		switch {
+		case key == "Go Version":
+			// go version go1.4.2 darwin/amd64
+			if fields := strings.Fields(val); len(fields) > 2 {
+				val = fields[2]
+			}
+			bi.GoVersion = val
+		case key == "GOOS":
+			bi.GOOS = val
+		case key == "GOARCH":
+			bi.GOARCH = val
+		case key == "Build Args":
+			bi.BuildArgs = val
+		case key == "Build Tags":
+			bi.BuildTags = val
+		case key+": " == harpVersionPrefix:
+			bi.HarpVersion = val
+		case strings.HasSuffix(key, " Checksum"):
+			bi.VCS = strings.TrimSuffix(key, " Checksum")
+			bi.Checksum = val
+		case key == "Composer":
+			bi.Composer = val
+		case key == "Release ID":
+			bi.ReleaseID = val
+		case key == "Build At":
+			// monotonic clock reading
+			if i := strings.Index(val, " m="); i > 0 {
+				val = val[:i]
+			}
+			if bi.BuildAt, err = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", val); err != nil {
+				return bi, fmt.Errorf("failed to parse build time %q: %s", val, err)
+			}
+		}
+	}
+	if bi.HarpVersion == "" && bi.Checksum == "" && bi.BuildAt.IsZero() {
+		return bi, fmt.Errorf("unknown build info format")
+	}
+	return
+}
+
+func (s *Server) getBuildInfo() (bi BuildInfo, err error) {
+	session := s.getSession()
+	defer session.Close()
+	output, err := session.CombinedOutput(fmt.Sprintf("cat %sharp-build.info", s.AppRoot()))
+	if err != nil {
+		return bi, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return parseBuildInfo(string(output))
+}
+
+// parseBinaryBuildInfo retrieves injected build info from output of
+// go version -m, which includes build flags like:
+//
+//	build	-ldflags="-X 'main.buildInfo={\"Composer\":\"van\"}'"
+func parseBinaryBuildInfo(output, name string) (bi BuildInfo, err error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+		if len(fields) != 2 || fields[0] != "build" || !strings.HasPrefix(fields[1], "-ldflags=") {
+			continue
+		}
+		flags := strings.TrimPrefix(fields[1], "-ldflags=")
+		if strings.HasPrefix(flags, `"`) {
+			if flags, err = strconv.Unquote(flags); err != nil {
+				return bi, fmt.Errorf("failed to unquote %s: %s", fields[1], err)
+			}
+		}
+		return decodeBuildInfoVar(flags, name)
+	}
+	return bi, fmt.Errorf("no -ldflags found")
+}
+
+// decodeBuildInfoVar decodes the json value of var name in data.
+func decodeBuildInfoVar(data, name string) (bi BuildInfo, err error) {
+	index := strings.Index(data, name+"={")
+	if index < 0 {
+		return bi, fmt.Errorf("%s is not found", name)
+	}
+	err = json.NewDecoder(strings.NewReader(data[index+len(name)+1:])).Decode(&bi)
+	return
+}
+
+// getBinaryBuildInfo queries build info injected in the installed binary.
+// It tries go version -m first, and falls back to search the json string in
+// the binary if go isn't installed on the server.
+func (s *Server) getBinaryBuildInfo() (BuildInfo, error) {
+	name := cfg.App.BuildInfoVar
+	output := s.exec(fmt.Sprintf("go version -m %s", s.BinPath()))
+	bi, err := parseBinaryBuildInfo(output, name)
+	if err == nil {
+		return bi, nil
+	}
+
+	output = s.exec(fmt.Sprintf(`grep -a -o '{"Go[^}]*"HarpVersion"[^}]*}' %s | head -n 1`, s.BinPath()))
+	if strings.TrimSpace(output) == "" {
+		return bi, fmt.Errorf("failed to find %s in %s: %s", name, s.BinPath(), err)
+	}
+	return decodeBuildInfoVar(name+"="+output, name)
+}
+
+type serverBuildInfo struct {
+	server *Server
+	info   BuildInfo
+	binary *BuildInfo
+	err    error
+}
+
+// buildInfoField is a field of BuildInfo checked for drifts.
+type buildInfoField struct {
+	name  string
+	value func(BuildInfo) string
+}
+
+var driftFields = []buildInfoField{
+	{"checksum", func(bi BuildInfo) string { return bi.Checksum }},
+	{"go version", func(bi BuildInfo) string { return bi.GoVersion }},
+	{"harp version", func(bi BuildInfo) string { return bi.HarpVersion }},
+	{"build time", func(bi BuildInfo) string { return fmtBuildTime(bi.BuildAt) }},
+}
+
+// drift means servers in the same set are running different values of a
+// field in build info.
+type drift struct {
+	set    string
+	field  string
+	values map[string][]string // value => servers
+}
+
+// majority returns the value that most servers have.
+func (d drift) majority() string {
+	var major string
+	for val, servers := range d.values {
+		if len(servers) > len(d.values[major]) || (len(servers) == len(d.values[major]) && val < major) {
+			major = val
+		}
+	}
+	return major
+}
+
+func (d drift) String() string {
+	var vals []string
+	for val := range d.values {
+		vals = append(vals, val)
+	}
+	sort.Strings(vals)
+	var strs []string
+	for _, val := range vals {
+		if val == "" {
+			strs = append(strs, fmt.Sprintf("(none) (%s)", strings.Join(d.values[val], ", ")))
+			continue
+		}
+		strs = append(strs, fmt.Sprintf("%s (%s)", val, strings.Join(d.values[val], ", ")))
+	}
+	return fmt.Sprintf("[%s] %s: %s", d.set, d.field, strings.Join(strs, " / "))
+}
+
+// findDrifts returns the drifts found in every server set. Servers that
+// failed to report build info are ignored.
+func findDrifts(infos []serverBuildInfo) (drifts []drift) {
+	sets := map[string][]serverBuildInfo{}
+	var setNames []string
+	for _, info := range infos {
+		if info.err != nil {
+			continue
+		}
+		if _, ok := sets[info.server.Set]; !ok {
+			setNames = append(setNames, info.server.Set)
+		}
+		sets[info.server.Set] = append(sets[info.server.Set], info)
+	}
+	sort.Strings(setNames)
+
+	for _, set := range setNames {
+		for _, field := range driftFields {
+			d := drift{set: set, field: field.name, values: map[string][]string{}}
+			for _, info := range sets[set] {
+				val := field.value(info.info)
+				d.values[val] = append(d.values[val], info.server.String())
+			}
+			if len(d.values) > 1 {
+				drifts = append(drifts, d)
+			}
+		}
+	}
+	return
+}
+
+func fmtBuildTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05 -0700")
+}
+
+func shortChecksum(checksum string) string {
+	if len(checksum) > 12 {
+		return checksum[:12]
+	}
+	return checksum
+}
+
+func info(servers []*Server) {
+	infos := make([]serverBuildInfo, len(servers))
+	eachServer(servers, func(i int, serv *Server) {
+		serv.initPathes()
+		infos[i].server = serv
+		infos[i].info, infos[i].err = serv.getBuildInfo()
+		if infos[i].err != nil || cfg.App.BuildInfoVar == "" {
+			return
+		}
+		if bi, err := serv.getBinaryBuildInfo(); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] failed to retrieve build info from binary: %s\n", serv, err)
+		} else {
+			infos[i].binary = &bi
+		}
+	})
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].server.Set != infos[j].server.Set {
+			return infos[i].server.Set < infos[j].server.Set
+		}
+		return infos[i].server.String() < infos[j].server.String()
+	})
+
+	drifts := findDrifts(infos)
+	// drifted values are marked with * in the table
+	minorities := map[string]map[string]bool{} // set/field => values
+	for _, d := range drifts {
+		major := d.majority()
+		m := map[string]bool{}
+		for val := range d.values {
+			m[val] = val != major
+		}
+		minorities[d.set+"/"+d.field] = m
+	}
+	mark := func(info serverBuildInfo, field buildInfoField, display string) string {
+		if minorities[info.server.Set+"/"+field.name][field.value(info.info)] {
+			return display + " *"
+		}
+		return display
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SET\tSERVER\tCHECKSUM\tGO\tHARP\tTARGET\tRELEASE\tCOMPOSER\tBUILD AT")
+	for _, info := range infos {
+		if info.err != nil {
+			fmt.Fprintf(w, "%s\t%s\terror: %s\n", info.server.Set, info.server, info.err)
+			continue
+		}
+		bi := info.info
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			info.server.Set, info.server,
+			mark(info, driftFields[0], shortChecksum(bi.Checksum)),
+			mark(info, driftFields[1], bi.GoVersion),
+			mark(info, driftFields[2], bi.HarpVersion),
+			strings.Trim(bi.GOOS+"/"+bi.GOARCH, "/"),
+			bi.ReleaseID,
+			bi.Composer,
+			mark(info, driftFields[3], fmtBuildTime(bi.BuildAt)),
+		)
+	}
+	w.Flush()
+
+	var mismatches []string
+	for _, info := range infos {
+		if info.binary == nil {
+			continue
+		}
+		if info.binary.Checksum != info.info.Checksum || !info.binary.BuildAt.Equal(info.info.BuildAt) {
+			mismatches = append(mismatches, fmt.Sprintf("[%s] %s: binary is built at %s (%s), harp-build.info says %s (%s)", info.server.Set, info.server, fmtBuildTime(info.binary.BuildAt), shortChecksum(info.binary.Checksum), fmtBuildTime(info.info.BuildAt), shortChecksum(info.info.Checksum)))
+		}
+	}
+
+	if len(drifts) > 0 || len(mismatches) > 0 {
+		fmt.Println("\ndrifts:")
+		for _, d := range drifts {
+			fmt.Println("    " + d.String())
+		}
+		for _, m := range mismatches {
+			fmt.Println("    " + m)
+		}
+	}
+
+	if option.verbose {
+		for _, info := range infos {
+			if info.err != nil {
+				continue
+			}
+			fmt.Printf("=====\n%s\n%s", info.server, info.info)
+			if info.binary != nil {
+				fmt.Printf("Binary Build Info:\n\t%s\n", strings.Replace(strings.TrimSpace(info.binary.String()), "\n", "\n\t", -1))
+			}
+		}
+	}
+
+	for _, info := range infos {
+		if info.err != nil {
+			os.Exit(1)
+		}
+	}
+}
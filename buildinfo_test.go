@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestParseBinaryBuildInfo(t *testing.T) {
+	output := `bi: go1.21.0
+	path	example.com/bi
+	build	-compiler=gc
+	build	-ldflags="-X 'main.buildInfo={\"VCS\":\"Git\",\"Checksum\":\"f8eb715\",\"Composer\":\"O\\u0027Brien van\",\"BuildAt\":\"2015-07-06T21:28:55Z\",\"HarpVersion\":\"0.6.5\",\"ReleaseID\":\"15-07-06-21:28:55\"}'"
+	build	GOOS=linux
+`
+	bi, err := parseBinaryBuildInfo(output, "main.buildInfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bi.Checksum != "f8eb715" || bi.Composer != "O'Brien van" || bi.ReleaseID != "15-07-06-21:28:55" || bi.BuildAt.IsZero() {
+		t.Errorf("unexpected build info: %+v", bi)
+	}
+
+	if _, err := parseBinaryBuildInfo(output, "main.version"); err == nil {
+		t.Error("expect error for unknown var")
+	}
+}
+
+func TestParseBuildInfo(t *testing.T) {
+	bi, err := parseBuildInfo(`Go Version: go version go1.4.2 darwin/amd64
+GOOS: linux
+GOARCH: amd64
+Harp Version: 0.6.5
+Git Checksum: f8eb715f33c36d8ec018fe116491a01540106fc8
+Composer: bom_d_van
+Build At: 2015-07-06 21:28:55.359181899 +0800 CST`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bi.GoVersion != "go1.4.2" || bi.GOARCH != "amd64" || bi.HarpVersion != "0.6.5" || bi.VCS != "Git" || bi.BuildAt.Year() != 2015 {
+		t.Errorf("unexpected build info: %+v", bi)
+	}
+
+	got, err := parseBuildInfo(bi.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.BuildAt.Equal(bi.BuildAt) || got.Checksum != bi.Checksum || got.GOOS != bi.GOOS {
+		t.Errorf("expect %+v got %+v", bi, got)
+	}
+}
+
+func TestFindDrifts(t *testing.T) {
+	newInfo := func(set, host, checksum, goVersion string) serverBuildInfo {
+		return serverBuildInfo{
+			server: &Server{User: "app", Host: host, Port: ":22", Set: set},
+			info:   BuildInfo{Checksum: checksum, GoVersion: goVersion, HarpVersion: "0.6.5"},
+		}
+	}
+	drifts := findDrifts([]serverBuildInfo{
+		newInfo("prod", "a", "c1", "go1.7"),
+		newInfo("prod", "b", "c1", "go1.7"),
+		newInfo("prod", "c", "c2", "go1.7"),
+		newInfo("dev", "d", "c3", "go1.6"),
+		newInfo("dev", "e", "c3", "go1.7"),
+	})
+	if len(drifts) != 2 {
+		t.Fatalf("expect 2 drifts got %d: %v", len(drifts), drifts)
+	}
+	if d := drifts[0]; d.set != "dev" || d.field != "go version" {
+		t.Errorf("unexpected drift: %s", d)
+	}
+	if d := drifts[1]; d.set != "prod" || d.field != "checksum" || d.majority() != "c1" {
+		t.Errorf("unexpected drift: %s", d)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/DisposaBoy/JsonConfigReader"
+	"gopkg.in/yaml.v2"
+)
+
+// Config file formats, detected by file extensions.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+// configFormat returns format of the config file by its extension, JSON for
+// unknown ones.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	}
+	return formatJSON
+}
+
+// defaultConfigPath returns the first existing one of harp.json, harp.yaml,
+// harp.yml and harp.toml.
+func defaultConfigPath() string {
+	for _, path := range []string{"harp.json", "harp.yaml", "harp.yml", "harp.toml"} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return "harp.json"
+}
+
+// loadConfig reads config files (with their Extends and Include) and merges
+// them in order, later ones take precedence.
+func loadConfig(paths []string) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for _, path := range paths {
+		conf, err := readConfigFile(path, nil)
+		if os.IsNotExist(err) {
+			exitf("Config %s doesn't exist or is unspecified.\nTo specify with flag -c (e.g. -c harp.json)", path)
+		} else if err != nil {
+			exitf("failed to read config: %s", err)
+		}
+		merged = mergeConfig(merged, conf)
+	}
+	return merged
+}
+
+// readConfigFile reads a config file, merged on top of the file it Extends
+// and the files it Includes, which are relative to the file. includers are
+// files including the current one, for detecting include cycles.
+func readConfigFile(path string, includers []string) (map[string]interface{}, error) {
+	return readConfigTree(path, includers, nil)
+}
+
+// readConfigTree is readConfigFile calling visit with content of every file
+// read, in the order of merging.
+func readConfigTree(path string, includers []string, visit func(path string, data []byte)) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range includers {
+		if p == abs {
+			return nil, fmt.Errorf("%s: include cycle", path)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := decodeConfig(configFormat(path), data)
+	if err != nil {
+		if visit != nil {
+			visit(path, data)
+		}
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	type base struct{ key, path string }
+	var bases []base
+	switch extends := conf["Extends"].(type) {
+	case nil:
+	case string:
+		bases = append(bases, base{"Extends", extends})
+	default:
+		return nil, fmt.Errorf("%s: Extends should be a file path", path)
+	}
+	switch include := conf["Include"].(type) {
+	case nil:
+	case []interface{}:
+		for _, inc := range include {
+			inc, ok := inc.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: Include should be a list of file paths", path)
+			}
+			bases = append(bases, base{"Include", inc})
+		}
+	default:
+		return nil, fmt.Errorf("%s: Include should be a list of file paths", path)
+	}
+	delete(conf, "Extends")
+	delete(conf, "Include")
+
+	merged := map[string]interface{}{}
+	for _, b := range bases {
+		file := b.path
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		baseConf, err := readConfigTree(file, append(includers, abs), visit)
+		if os.IsNotExist(err) {
+			// names the includer, loadConfig only reports missing -c files
+			return nil, fmt.Errorf("%s: %s %s: %s", path, b.key, b.path, err)
+		} else if err != nil {
+			return nil, err
+		}
+		merged = mergeConfig(merged, baseConf)
+	}
+	if visit != nil {
+		visit(path, data)
+	}
+	return mergeConfig(merged, conf), nil
+}
+
+// decodeConfig decodes config in format. Values are normalized to the types
+// of encoding/json, except for numbers, which are json.Number.
+func decodeConfig(format string, data []byte) (map[string]interface{}, error) {
+	conf, err := decodeConfigValue(format, data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := conf.(map[string]interface{})
+	if !ok && conf != nil {
+		return nil, errors.New("config should be an object")
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	return m, nil
+}
+
+// decodeConfigValue is decodeConfig accepting any values at top level.
+func decodeConfigValue(format string, data []byte) (interface{}, error) {
+	var conf interface{}
+	switch format {
+	case formatYAML:
+		if err := yaml.Unmarshal(data, &conf); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		var m map[string]interface{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+		conf = m
+	default:
+		dec := json.NewDecoder(JsonConfigReader.New(bytes.NewReader(data)))
+		dec.UseNumber()
+		if err := dec.Decode(&conf); err != nil {
+			return nil, err
+		}
+	}
+	return normalizeConfigValue(conf)
+}
+
+// normalizeConfigValue converts values decoded from YAML and TOML (e.g.
+// map[interface{}]interface{}, []map[string]interface{} and int64) to the
+// ones of JSON.
+func normalizeConfigValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case nil, string, bool, json.Number:
+		return v, nil
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			var err error
+			if m[k], err = normalizeConfigValue(e); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v should be a string", k)
+			}
+			var err error
+			if m[key], err = normalizeConfigValue(e); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			var err error
+			if list[i], err = normalizeConfigValue(rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return json.Number(fmt.Sprint(val)), nil
+	}
+	return nil, fmt.Errorf("unsupported value %v (%T)", val, val)
+}
+
+// encodeConfig encodes config decoded by decodeConfig in format.
+func encodeConfig(format string, conf map[string]interface{}) ([]byte, error) {
+	if format == formatJSON {
+		data, err := json.MarshalIndent(conf, "", "\t")
+		return append(data, '\n'), err
+	}
+
+	native, err := nativeConfigValue(format, conf, "")
+	if err != nil {
+		return nil, err
+	}
+	if format == formatYAML {
+		return yaml.Marshal(native)
+	}
+	var buf bytes.Buffer
+	err = toml.NewEncoder(&buf).Encode(native)
+	return buf.Bytes(), err
+}
+
+// nativeConfigValue converts json.Number to int64 or float64 for YAML and
+// TOML encoders. As TOML doesn't support null and mixed arrays, nulls are
+// rejected and Files in string form are converted to objects for TOML.
+func nativeConfigValue(format string, val interface{}, key string) (interface{}, error) {
+	switch v := val.(type) {
+	case nil:
+		if format == formatTOML {
+			return nil, fmt.Errorf("%s: null is not supported in TOML", key)
+		}
+		return nil, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			var err error
+			if m[k], err = nativeConfigValue(format, e, joinKeyPath(key, k)); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			if path, ok := e.(string); ok && format == formatTOML && strings.HasSuffix(key, "Files") {
+				e = map[string]interface{}{"Path": path}
+			}
+			var err error
+			if list[i], err = nativeConfigValue(format, e, key); err != nil {
+				return nil, err
+			}
+		}
+		if format == formatTOML && len(list) > 0 {
+			if _, ok := list[0].(map[string]interface{}); ok {
+				// encoded as array of tables
+				tables := make([]map[string]interface{}, len(list))
+				for i, e := range list {
+					if tables[i], ok = e.(map[string]interface{}); !ok {
+						return nil, fmt.Errorf("%s: mixed arrays are not supported in TOML", key)
+					}
+				}
+				return tables, nil
+			}
+		}
+		return list, nil
+	}
+	return val, nil
+}
+
+// mergeConfig deep merges overlay into a copy of base. Objects are merged
+// recursively and null removes the field. Lists are replaced, except for
+// Files, which are merged by Path, and server lists in Servers, which are
+// merged by ID, or Host and Port for servers without ID.
+func mergeConfig(base, overlay map[string]interface{}) map[string]interface{} {
+	return mergeConfigValue("", base, overlay).(map[string]interface{})
+}
+
+func mergeConfigValue(key string, base, overlay interface{}) interface{} {
+	switch o := overlay.(type) {
+	case map[string]interface{}:
+		b, _ := base.(map[string]interface{})
+		merged := map[string]interface{}{}
+		for k, v := range b {
+			merged[k] = v
+		}
+		for k, v := range o {
+			if v == nil {
+				delete(merged, k)
+				continue
+			}
+			childKey := k
+			if key == "Servers" {
+				childKey = "Servers.*"
+			}
+			merged[k] = mergeConfigValue(childKey, merged[k], v)
+		}
+		return merged
+	case []interface{}:
+		b, _ := base.([]interface{})
+		switch key {
+		case "Files":
+			return mergeConfigList(b, o, fileConfigKey)
+		case "Servers.*":
+			return mergeConfigList(b, o, serverConfigKey)
+		}
+	}
+	return overlay
+}
+
+// mergeConfigList merges overlay items into the base items with the same
+// key, or appends them.
+func mergeConfigList(base, overlay []interface{}, key func(interface{}) string) []interface{} {
+	merged := append([]interface{}{}, base...)
+	for _, item := range overlay {
+		k := key(item)
+		found := false
+		for i, b := range merged[:len(base)] {
+			if k != "" && key(b) == k {
+				merged[i] = mergeConfigValue("", b, item)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+func fileConfigKey(f interface{}) string {
+	switch f := f.(type) {
+	case string:
+		return f
+	case map[string]interface{}:
+		path, _ := f["Path"].(string)
+		return path
+	}
+	return ""
+}
+
+func serverConfigKey(s interface{}) string {
+	m, ok := s.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if id, _ := m["ID"].(string); id != "" {
+		return "id:" + id
+	}
+	host, _ := m["Host"].(string)
+	port, _ := m["Port"].(string)
+	if host == "" {
+		return ""
+	}
+	return "host:" + host + port
+}
+
+// convertConfigFile translates config file src to dst in the format of its
+// extension. Comments are not kept.
+func convertConfigFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	conf, err := decodeConfig(configFormat(src), data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+	if data, err = encodeConfig(configFormat(dst), conf); err != nil {
+		return fmt.Errorf("%s: %s", dst, err)
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
+
+const configUsage = "usage: harp config show [json|yaml|toml] | convert SRC DST"
+
+func configCmd(args []string) {
+	switch {
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "show":
+		format := formatJSON
+		if len(args) == 2 {
+			format = args[1]
+		}
+		if format != formatJSON && format != formatYAML && format != formatTOML {
+			exitf(configUsage)
+		}
+		data, err := encodeConfig(format, loadConfig(option.configPaths))
+		if err != nil {
+			exitf("failed to encode config: %s", err)
+		}
+		fmt.Print(string(data))
+	case len(args) == 3 && args[0] == "convert":
+		if err := convertConfigFile(args[1], args[2]); err != nil {
+			exitf("failed to convert config: %s", err)
+		}
+	default:
+		exitf(configUsage)
+	}
+}
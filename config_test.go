@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"base.json": `{
+			// base config
+			"RollbackCount": 3,
+			"App": {
+				"Name": "app",
+				"Envs": {"A": "base", "B": "base"},
+				"Files": ["a", {"Path": "b", "Excludeds": ["tmp"]}]
+			},
+			"Servers": {
+				"prod": [{"ID": "p1", "Host": "h1", "User": "app"}, {"Host": "h2", "Port": ":22"}]
+			}
+		}`,
+		"common.json": `{"App": {"Envs": {"C": "common"}}}`,
+		"prod.json": `{
+			"Extends": "base.json",
+			"Include": ["common.json"],
+			"App": {
+				"Envs": {"B": "prod", "A": null},
+				"Files": [{"Path": "b", "Delete": true}, "c"]
+			},
+			"Servers": {
+				"prod": [{"ID": "p1", "User": "root"}, {"Host": "h2", "Port": ":22", "GoPath": "/go"}, {"Host": "h3"}]
+			}
+		}`,
+		"local.json":  `{"RollbackCount": 1}`,
+		"cycle.json":  `{"Include": ["cycle.json"]}`,
+		"broken.json": `{"Extends": "base.json", "Include": ["nowhere.json"]}`,
+		"nested.json": `{"Extends": "broken.json"}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, _ := json.Marshal(loadConfig([]string{filepath.Join(dir, "prod.json"), filepath.Join(dir, "local.json")}))
+	want := `{"App":{"Envs":{"B":"prod","C":"common"},"Files":["a",{"Delete":true,"Excludeds":["tmp"],"Path":"b"},"c"],"Name":"app"},` +
+		`"RollbackCount":1,` +
+		`"Servers":{"prod":[{"Host":"h1","ID":"p1","User":"root"},{"GoPath":"/go","Host":"h2","Port":":22"},{"Host":"h3"}]}}`
+	if string(got) != want {
+		t.Errorf("loadConfig =\n%s\nwant\n%s", got, want)
+	}
+
+	cfg := parseCfg(filepath.Join(dir, "prod.json"))
+	if !reflect.DeepEqual(cfg.App.Envs, map[string]string{"B": "prod", "C": "common"}) || len(cfg.App.Files) != 3 || !cfg.App.Files[1].Delete {
+		t.Errorf("parseCfg = %+v", cfg.App)
+	}
+
+	if _, err := readConfigFile(filepath.Join(dir, "cycle.json"), nil); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("err = %v; want include cycle", err)
+	}
+
+	// missing bases are reported with the file including them, rather than
+	// as a missing -c file
+	for _, name := range []string{"broken.json", "nested.json"} {
+		_, err := readConfigFile(filepath.Join(dir, name), nil)
+		if want := filepath.Join(dir, "broken.json") + ": Include nowhere.json: "; err == nil || os.IsNotExist(err) || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: err = %v; want %q", name, err, want)
+		}
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yamlConf := `
+RollbackCount: 5
+App:
+  Name: app
+  Files:
+  - github.com/bom-d-van/harp/test/files
+  - Path: github.com/bom-d-van/harp/test/file
+    Delete: true
+Servers:
+  prod:
+  - Host: 192.168.59.103
+    Port: ":49153"
+    Envs: {A: "1"}
+`
+	tomlConf := `
+RollbackCount = 5
+
+[App]
+Name = "app"
+
+[[App.Files]]
+Path = "github.com/bom-d-van/harp/test/files"
+
+[[App.Files]]
+Path = "github.com/bom-d-van/harp/test/file"
+Delete = true
+
+[[Servers.prod]]
+Host = "192.168.59.103"
+Port = ":49153"
+Envs = {A = "1"}
+`
+	yamlPath := filepath.Join(dir, "harp.yaml")
+	tomlPath := filepath.Join(dir, "harp.toml")
+	ioutil.WriteFile(yamlPath, []byte(yamlConf), 0644)
+	ioutil.WriteFile(tomlPath, []byte(tomlConf), 0644)
+
+	check := func(name string, cfg Config) {
+		if cfg.RollbackCount != 5 || cfg.App.Name != "app" || len(cfg.App.Files) != 2 ||
+			cfg.App.Files[0].Path != "github.com/bom-d-van/harp/test/files" || !cfg.App.Files[1].Delete ||
+			cfg.Servers["prod"][0].String() != "@192.168.59.103:49153" || cfg.Servers["prod"][0].Envs["A"] != "1" {
+			t.Errorf("%s: unexpected config: %+v", name, cfg)
+		}
+	}
+	check("yaml", parseCfg(yamlPath))
+	check("toml", parseCfg(tomlPath))
+
+	for _, dst := range []string{"harp.json", "harp.yml", "harp.toml"} {
+		dst = filepath.Join(dir, "converted", dst)
+		os.MkdirAll(filepath.Dir(dst), 0755)
+		if err := convertConfigFile(yamlPath, dst); err != nil {
+			t.Fatal(err)
+		}
+		check(dst, parseCfg(dst))
+	}
+}
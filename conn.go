@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Default connection settings, see Config.
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultConnectRetries = 2
+	defaultKeepAlive      = 30 * time.Second
+	keepAliveCountMax     = 3
+)
+
+// parseDuration parses duration settings in harp.json, an empty str returns
+// def.
+func parseDuration(name, str string, def time.Duration) time.Duration {
+	if str == "" {
+		return def
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		exitf("failed to parse %s: %s", name, err)
+	}
+	return d
+}
+
+func connectTimeout() time.Duration {
+	return parseDuration("ConnectTimeout", cfg.ConnectTimeout, defaultConnectTimeout)
+}
+
+func commandTimeout() time.Duration {
+	return parseDuration("CommandTimeout", cfg.CommandTimeout, 0)
+}
+
+func connectRetries() int {
+	switch {
+	case cfg.ConnectRetries < 0:
+		return 0
+	case cfg.ConnectRetries == 0:
+		return defaultConnectRetries
+	}
+	return cfg.ConnectRetries
+}
+
+// keepAliveInterval returns ServerAliveInterval in ssh config or KeepAlive
+// in harp.json.
+func (s *Server) keepAliveInterval() time.Duration {
+	if s.aliveInterval > 0 {
+		return s.aliveInterval
+	}
+	return parseDuration("KeepAlive", cfg.KeepAlive, defaultKeepAlive)
+}
+
+type serverMutexes struct {
+	client sync.Mutex
+	setUp  sync.Mutex
+}
+
+var serversMutexes = struct {
+	sync.Mutex
+	m map[*Server]*serverMutexes
+}{m: map[*Server]*serverMutexes{}}
+
+func (s *Server) mutexes() *serverMutexes {
+	serversMutexes.Lock()
+	defer serversMutexes.Unlock()
+	m := serversMutexes.m[s]
+	if m == nil {
+		m = &serverMutexes{}
+		serversMutexes.m[s] = m
+	}
+	return m
+}
+
+// clientMutex returns the mutex guarding connection of the server, as a
+// proxy might be connected by servers behind it concurrently.
+func (s *Server) clientMutex() *sync.Mutex { return &s.mutexes().client }
+
+// setUpMutex returns the mutex guarding initPathes of the server.
+func (s *Server) setUpMutex() *sync.Mutex { return &s.mutexes().setUp }
+
+// initClient connects the server, through its proxy chain if any, and
+// retries with backoff on transient errors. Every server (proxies included)
+// is connected only once, all sessions share the connection.
+func (s *Server) initClient() {
+	mutex := s.clientMutex()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s.client != nil {
+		return
+	}
+
+	if s.Proxy != nil {
+		s.Proxy.initClient()
+	}
+
+	retries := connectRetries()
+	for attempt := 0; ; attempt++ {
+		client, err := s.dial()
+		if err == nil {
+			s.client = client
+			s.keepAlive(client)
+			return
+		}
+
+		if attempt < retries && isTransientErr(err) {
+			backoff := time.Second << uint(attempt)
+			log.Printf("[%s] failed to connect: %s, retry in %s\n", s, err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+
+		if s.Proxy != nil {
+			s.exitf("failed to connect %s via bastion host %s: %s", s, s.Proxy, err)
+		}
+		fmt.Fprintf(os.Stderr, "failed to dial %s: %s\n\n", s, err)
+		if !isTransientErr(err) {
+			fmt.Println("Harp tries ssh-agent, key files, password and keyboard-interactive authentications by default.")
+			fmt.Println("Make sure you have added your private key in ssh-agent (ssh-add -l), or configured Auth, Key or Password of the server.")
+			fmt.Println("More information could be found here: https://github.com/bom-d-van/harp#server-access-using-ssh")
+		}
+		if option.debug {
+			debug.PrintStack()
+		}
+		removeRuntimeDir()
+		os.Exit(1)
+	}
+}
+
+// dial connects the server directly or from its proxy. ConnectTimeout is
+// applied to both of tcp connection and ssh handshake, except for the time
+// waiting for user input (passphrases, passwords and unknown host keys).
+func (s *Server) dial() (*ssh.Client, error) {
+	timeout := connectTimeout()
+	var conn net.Conn
+	var err error
+	if s.Proxy == nil {
+		conn, err = net.DialTimeout("tcp", s.addr(), timeout)
+	} else {
+		conn, err = dialFrom(s.Proxy.client, s.addr(), timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := s.clientConfig()
+	var timedOut int32
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		if atomic.LoadInt32(&prompting) > 0 {
+			timer.Reset(timeout)
+			return
+		}
+		atomic.StoreInt32(&timedOut, 1)
+		conn.Close()
+	})
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.addr(), config)
+	timer.Stop()
+	if err != nil {
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, timeoutError(fmt.Sprintf("ssh handshake timed out after %s", timeout))
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialFrom connects addr from client within timeout.
+func dialFrom(client *ssh.Client, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resultc := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial("tcp", addr)
+		resultc <- result{conn, err}
+	}()
+	select {
+	case r := <-resultc:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-resultc; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, timeoutError(fmt.Sprintf("dial %s timed out after %s", addr, timeout))
+	}
+}
+
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// isTransientErr reports whether a connection error is worth retrying, like
+// timeouts and refused connections, but not authentication or host key
+// errors.
+func isTransientErr(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		switch errno {
+		case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return true
+		}
+	}
+	// errors from ssh package are not wrapped
+	msg := err.Error()
+	return strings.HasSuffix(msg, "handshake failed: EOF") ||
+		strings.Contains(msg, "connection reset by peer") ||
+		strings.Contains(msg, "connect failed") // ssh: rejected: connect failed (from proxy)
+}
+
+func (s *Server) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:              s.User,
+		Auth:              s.authMethods(),
+		HostKeyCallback:   s.verifyHostKey,
+		HostKeyAlgorithms: s.hostKeyAlgorithms(),
+	}
+}
+
+// keepAlive sends keepalive requests every keepAliveInterval. The connection
+// is closed if the server doesn't respond 3 times in a row, so that sessions
+// on dead connections fail rather than hang.
+func (s *Server) keepAlive(client *ssh.Client) {
+	interval := s.keepAliveInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var missed int
+		for range ticker.C {
+			errc := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				errc <- err
+			}()
+			select {
+			case err := <-errc:
+				if err != nil {
+					return
+				}
+				missed = 0
+			case <-time.After(interval):
+				if missed++; missed >= keepAliveCountMax {
+					log.Printf("[%s] server is not responding, connection is closed\n", s)
+					client.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// getSession returns a new session of the shared connection, which is closed
+// after CommandTimeout.
+func (s *Server) getSession() *ssh.Session {
+	return s.newSession(commandTimeout())
+}
+
+// newSession returns a new session closed after timeout, 0 means no timeout.
+// It's for long running commands, like log tailing and migrations.
+func (s *Server) newSession(timeout time.Duration) *ssh.Session {
+	session, err := s.openSession(timeout)
+	if err != nil {
+		s.exitf("failed to get session to server %s: %s", s, err)
+	}
+	return session
+}
+
+func (s *Server) openSession(timeout time.Duration) (*ssh.Session, error) {
+	s.initPathes()
+	return s.clientSession(timeout)
+}
+
+// clientSession opens a session of the connection, without setting up the
+// server as openSession.
+func (s *Server) clientSession(timeout time.Duration) (*ssh.Session, error) {
+	s.initClient()
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		// it's a noop for closed sessions
+		time.AfterFunc(timeout, func() { session.Close() })
+	}
+	return session, nil
+}
+
+func (s *Server) exec(cmd string) string {
+	session, err := s.openSession(commandTimeout())
+	if err != nil {
+		// fmt.Printf("%s: %s\n", s, err)
+		return err.Error()
+	}
+
+	output, err := session.CombinedOutput(cmd)
+	if err != nil {
+		output = append([]byte(err.Error()+"\n"), output...)
+	}
+	session.Close()
+	return string(output)
+}
+
+// disconnect closes connection of the server, which is reconnected on
+// demand. Proxies are kept connected for other servers.
+func (s *Server) disconnect() {
+	mutex := s.clientMutex()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+}
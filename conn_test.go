@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsTransientErr(t *testing.T) {
+	_, refused := net.Dial("tcp", "127.0.0.1:1")
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{io.EOF, true},
+		{refused, true},
+		{timeoutError("dial timed out"), true},
+		{errors.New("ssh: handshake failed: EOF"), true},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain"), false},
+		{errors.New("ssh: handshake failed: host key of web-1 is unknown"), false},
+	} {
+		if got := isTransientErr(c.err); got != c.want {
+			t.Errorf("isTransientErr(%v) = %t; want %t", c.err, got, c.want)
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accept connections but never speak ssh
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.ConnectTimeout = "100ms"
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	s := &Server{Host: host, Port: ":" + port, User: "app", Auth: []string{authPassword}, Password: "secret", HostKey: "SHA256:xxx"}
+	start := time.Now()
+	_, err = s.dial()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err = %v; want timeout", err)
+	}
+	if !isTransientErr(err) {
+		t.Error("timeout should be transient")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("dial took %s", d)
+	}
+}
@@ -54,7 +54,7 @@ func startConsole(servers []*Server) {
 				}
 				fmt.Println(prompt)
 				if strings.TrimSpace(output.output) != "" {
-					fmt.Printf(output.output)
+					fmt.Print(output.output)
 				}
 				if count++; count >= len(servers) {
 					break
@@ -64,10 +64,14 @@ func startConsole(servers []*Server) {
 			wg.Done()
 		}()
 
+		l := newLimiter(len(servers))
 		for _, serv := range servers {
 			wg.Add(1)
+			l.acquire()
 			go func(serv *Server) {
-				outputc <- output{serv: serv, output: serv.exec(line)}
+				out := serv.exec(line)
+				l.release()
+				outputc <- output{serv: serv, output: out}
 				wg.Done()
 			}(serv)
 		}
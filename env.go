@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// EnvPath returns path of the env file sourced by restart and rollback
+// scripts. It's saved in every release for rollback. It's only written by
+// deploy and restart, migrations receive envs by stdin.
+func (s *Server) EnvPath() string { return fmt.Sprintf("%s/harp/%s/env", s.Home, cfg.App.Name) }
+
+// appEnvs returns the effective environment variables of the app on the
+// server, with secrets revealed. It's the only place resolving envs, used by
+// deploy, restart and migrations. Later layers take precedence: GOPATH,
+// App.Envs, Envs of Defaults, Envs of the server set (Defaults.Envs, then
+// Envs), Envs of the server and -e flags.
+func (s *Server) appEnvs() map[string]string {
+	envs := map[string]string{}
+	if s.GoPath != "" {
+		envs["GOPATH"] = s.GoPath
+	}
+	set := s.serverSet()
+	layers := []map[string]string{cfg.App.Envs}
+	for _, defaults := range []*Server{cfg.Defaults, set.Defaults} {
+		if defaults != nil {
+			layers = append(layers, defaults.Envs)
+		}
+	}
+	layers = append(layers, set.Envs, s.Envs, cliEnvs())
+	for _, layer := range layers {
+		for k, v := range revealEnvs(layer) {
+			envs[k] = v
+		}
+	}
+	return envs
+}
+
+// cliEnvs returns envs specified by -e flags.
+func cliEnvs() map[string]string {
+	envs := map[string]string{}
+	for _, kv := range option.envs {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			exitf("bad -e %q: KEY=VALUE is expected", kv)
+		}
+		envs[kv[:i]] = kv[i+1:]
+	}
+	return envs
+}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envFileSecretsPrefix starts the comment in env files listing names of
+// envs containing secrets, so that harp env never prints their values.
+const envFileSecretsPrefix = "# secrets:"
+
+// envFile returns content of an env file: sorted export statements with
+// values single quoted, so that any values, including the ones containing
+// quotes, dollar signs or new lines, are kept as they are.
+func envFile(envs map[string]string) (string, error) {
+	var names []string
+	for k := range envs {
+		if !envNameRegexp.MatchString(k) {
+			return "", fmt.Errorf("invalid environment variable name: %q", k)
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("# generated by harp, changes are overwritten on deploy and restart\n")
+	buf.WriteString(envFileSecretsPrefix)
+	for _, k := range names {
+		if redact(envs[k]) != envs[k] {
+			buf.WriteString(" " + k)
+		}
+	}
+	buf.WriteString("\n")
+	for _, k := range names {
+		fmt.Fprintf(&buf, "export %s=%s\n", k, shellQuote(envs[k]))
+	}
+	return buf.String(), nil
+}
+
+// envFileScript returns shell commands sourcing the env file if it exists.
+func (s *Server) envFileScript() string {
+	return fmt.Sprintf("if [[ -f %[1]s ]]; then\n\t. %[1]s\nfi\n", s.EnvPath())
+}
+
+// saveEnvFile writes the effective environment variables into the env file
+// on the server, readable only by the owner. Content is sent by stdin, so
+// values never show up in scripts or process lists.
+func (s *Server) saveEnvFile() {
+	content, err := envFile(s.appEnvs())
+	if err != nil {
+		s.exitf("failed to generate env file: %s", err)
+	}
+	session := s.getSession()
+	defer session.Close()
+	session.Stdin = bytes.NewBufferString(content)
+	path := s.EnvPath()
+	cmd := fmt.Sprintf("umask 077 && cat > %[1]s.tmp && chmod 600 %[1]s.tmp && mv -f %[1]s.tmp %[1]s", path)
+	if output, err := session.CombinedOutput(cmd); err != nil {
+		s.exitf("failed to save env file on %s: %s: %s", s, err, string(output))
+	}
+}
+
+// parseEnvFile parses env files generated by envFile.
+func parseEnvFile(content string) (map[string]string, error) {
+	envs := map[string]string{}
+	for len(content) > 0 {
+		var line string
+		if i := strings.Index(content, "\n"); i >= 0 {
+			line, content = content[:i], content[i+1:]
+		} else {
+			line, content = content, ""
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !strings.HasPrefix(line, "export ") || !strings.Contains(line, "=") {
+			return nil, fmt.Errorf("unexpected line: %q", line)
+		}
+		i := strings.Index(line, "=")
+		name := line[len("export "):i]
+
+		// value is made of single quoted strings and \', which might
+		// contain new lines
+		rest := line[i+1:] + "\n" + content
+		var val bytes.Buffer
+		for {
+			if strings.HasPrefix(rest, `\'`) {
+				val.WriteByte('\'')
+				rest = rest[2:]
+				continue
+			}
+			if len(rest) == 0 || rest[0] != '\'' {
+				break
+			}
+			end := strings.Index(rest[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated value of %s", name)
+			}
+			val.WriteString(rest[1 : end+1])
+			rest = rest[end+2:]
+		}
+		if !strings.HasPrefix(rest, "\n") {
+			return nil, fmt.Errorf("unexpected value of %s", name)
+		}
+		envs[name] = val.String()
+		content = rest[1:]
+	}
+	return envs, nil
+}
+
+// parseEnvFileSecrets returns names of envs containing secrets in env files
+// generated by envFile, nil if the file doesn't tell (e.g. generated by older
+// harp).
+func parseEnvFileSecrets(content string) map[string]bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, envFileSecretsPrefix) {
+			secrets := map[string]bool{}
+			for _, k := range strings.Fields(strings.TrimPrefix(line, envFileSecretsPrefix)) {
+				secrets[k] = true
+			}
+			return secrets
+		}
+	}
+	return nil
+}
+
+// parseEnviron parses /proc/$pid/environ.
+func parseEnviron(data string) map[string]string {
+	envs := map[string]string{}
+	for _, kv := range strings.Split(data, "\x00") {
+		if i := strings.Index(kv, "="); i > 0 {
+			envs[kv[:i]] = kv[i+1:]
+		}
+	}
+	return envs
+}
+
+// envDiff compares the effective envs (want) with the running ones (have).
+// Only keys in want and deployed are compared, as the process also inherits
+// envs like HOME and PATH from ssh sessions. Lines are prefixed by "+" (to
+// add), "-" (to remove), "~" (to change) or spaces (unchanged).
+//
+// Running values are only printed if secrets (of the deployed env file, see
+// parseEnvFileSecrets) tells they are not secrets, as secrets removed from
+// the config are not redacted.
+func envDiff(want, have, deployed map[string]string, secrets map[string]bool) []string {
+	keys := map[string]bool{}
+	for k := range want {
+		keys[k] = true
+	}
+	for k := range deployed {
+		keys[k] = true
+	}
+	var names []string
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, k := range names {
+		w, inWant := want[k]
+		h, inHave := have[k]
+		switch {
+		case inWant && !inHave:
+			lines = append(lines, "+ "+k+"="+envValue(w))
+		case !inWant && inHave:
+			if secrets == nil || secrets[k] {
+				h = "******"
+			}
+			lines = append(lines, "- "+k+"="+envValue(h))
+		case !inWant:
+		case w != h:
+			if secrets == nil || secrets[k] || redact(w) != w {
+				h = "******"
+			}
+			lines = append(lines, "~ "+k+"="+envValue(w)+" (running: "+envValue(h)+")")
+		default:
+			lines = append(lines, "  "+k+"="+envValue(w))
+		}
+	}
+	return lines
+}
+
+// envValue formats val for printing, values with special characters (e.g.
+// new lines) are quoted. Secrets are redacted.
+func envValue(val string) string {
+	val = redact(val)
+	if strconv.Quote(val) != `"`+val+`"` {
+		return strconv.Quote(val)
+	}
+	return val
+}
+
+const environMarker = "\x00harp:environ\x00"
+
+// runningEnvScriptTmpl prints the env file, and environment of the running
+// process if it's readable (linux only).
+var runningEnvScriptTmpl = template.Must(template.New("").Parse(`cat {{.EnvPath}} 2>/dev/null
+printf '\0harp:environ\0'
+if [[ -f {{.PIDPath}} ]]; then
+	pid=$(cat {{.PIDPath}})
+	if ps -p $pid > /dev/null 2>&1; then
+		echo "running"
+		cat /proc/$pid/environ 2>/dev/null
+	fi
+fi`))
+
+// runningEnvs returns envs in the deployed env file, names of the ones
+// containing secrets, and envs of the running process, source tells where
+// the latter is from.
+func (s *Server) runningEnvs() (deployed map[string]string, secrets map[string]bool, running map[string]string, source string, err error) {
+	var script bytes.Buffer
+	if err := runningEnvScriptTmpl.Execute(&script, s); err != nil {
+		s.exitf("failed to execute runningEnvScriptTmpl: %s", err)
+	}
+	session := s.getSession()
+	defer session.Close()
+	output, err := session.CombinedOutput(script.String())
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	parts := strings.SplitN(string(output), environMarker, 2)
+	if len(parts) != 2 {
+		return nil, nil, nil, "", errors.New("unexpected output: " + string(output))
+	}
+	if deployed, err = parseEnvFile(parts[0]); err != nil {
+		return nil, nil, nil, "", fmt.Errorf("failed to parse %s: %s", s.EnvPath(), err)
+	}
+	secrets = parseEnvFileSecrets(parts[0])
+	switch {
+	case !strings.HasPrefix(parts[1], "running\n"):
+		return deployed, secrets, deployed, "env file, app is not running", nil
+	case len(parts[1]) == len("running\n"):
+		return deployed, secrets, deployed, "env file, environment of the process is not readable", nil
+	}
+	return deployed, secrets, parseEnviron(parts[1][len("running\n"):]), "running process", nil
+}
+
+// printEnvs prints the effective environment of servers, and its diff
+// against the running one.
+func printEnvs(servers []*Server) {
+	outputs := make([]string, len(servers))
+	eachServer(servers, func(i int, s *Server) {
+		want := s.appEnvs()
+		var buf bytes.Buffer
+		fmt.Fprintln(&buf, "# ====================================")
+		deployed, secrets, running, source, err := s.runningEnvs()
+		if err != nil {
+			fmt.Fprintf(&buf, "# %s\nfailed to retrieve environment: %s\n", s, err)
+			outputs[i] = buf.String()
+			return
+		}
+		fmt.Fprintf(&buf, "# %s (compared with %s)\n", s, source)
+		for _, line := range envDiff(want, running, deployed, secrets) {
+			fmt.Fprintln(&buf, line)
+		}
+		outputs[i] = buf.String()
+	})
+	for _, output := range outputs {
+		fmt.Print(output)
+	}
+}
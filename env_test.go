@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvFile(t *testing.T) {
+	envs := map[string]string{
+		"PLAIN":  "value",
+		"QUOTES": `it's "quoted"`,
+		"SHELL":  "$HOME `id` $(id) \\ ; &",
+		"LINES":  "line 1\nline 2\n",
+		"EMPTY":  "",
+	}
+	content, err := envFile(envs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range envs {
+		out, err := exec.Command("sh", "-c", content+`printf %s "$`+k+`"`).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %s", err, out)
+		}
+		if string(out) != want {
+			t.Errorf("%s = %q; want %q", k, out, want)
+		}
+	}
+	if i, j := strings.Index(content, "EMPTY"), strings.Index(content, "SHELL"); i > j {
+		t.Errorf("envs are not sorted:\n%s", content)
+	}
+
+	if _, err := envFile(map[string]string{"BAD NAME": "x"}); err == nil {
+		t.Error("invalid name is accepted")
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	envs := map[string]string{
+		"A": "it's\n'quoted'\n",
+		"B": "",
+		"C": `\'`,
+	}
+	content, err := envFile(envs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseEnvFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, envs) {
+		t.Errorf("parseEnvFile = %q; want %q", got, envs)
+	}
+	if secrets := parseEnvFileSecrets(content); secrets == nil || len(secrets) > 0 {
+		t.Errorf("parseEnvFileSecrets = %v; want empty", secrets)
+	}
+
+	defer func() { redactions.values = nil }()
+	addRedaction("s3cret")
+	content, err = envFile(map[string]string{"DSN": "app:s3cret@db", "PLAIN": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parseEnvFileSecrets(content), map[string]bool{"DSN": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEnvFileSecrets = %v; want %v", got, want)
+	}
+	if secrets := parseEnvFileSecrets("export A='1'\n"); secrets != nil {
+		t.Errorf("parseEnvFileSecrets of old env file = %v; want nil", secrets)
+	}
+}
+
+func TestAppEnvs(t *testing.T) {
+	oldCfg, oldEnvs := cfg, option.envs
+	defer func() { cfg, option.envs = oldCfg, oldEnvs }()
+	cfg.App.Envs = map[string]string{"A": "app", "B": "app", "C": "app", "D": "app"}
+	cfg.ServerSets = map[string]*ServerSet{"prod": {Envs: map[string]string{"B": "set", "C": "set", "D": "set"}}}
+	option.envs = FlagStrings{"D=cli=1"}
+	s := &Server{Set: "prod", GoPath: "/go", Envs: map[string]string{"C": "server", "D": "server"}}
+
+	want := map[string]string{"GOPATH": "/go", "A": "app", "B": "set", "C": "server", "D": "cli=1"}
+	if got := s.appEnvs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("appEnvs = %v; want %v", got, want)
+	}
+}
+
+func TestEnvDiff(t *testing.T) {
+	want := map[string]string{"SAME": "1", "NEW": "2", "CHANGED": "new"}
+	deployed := map[string]string{"SAME": "1", "CHANGED": "old", "REMOVED": "3"}
+	running := map[string]string{"SAME": "1", "CHANGED": "old", "REMOVED": "3", "HOME": "/home/app"}
+	for _, c := range []struct {
+		secrets map[string]bool
+		lines   []string
+	}{
+		{map[string]bool{}, []string{"~ CHANGED=new (running: old)", "+ NEW=2", "- REMOVED=3", "  SAME=1"}},
+		// secrets removed from the config or replaced by plain values
+		{map[string]bool{"CHANGED": true, "REMOVED": true}, []string{"~ CHANGED=new (running: ******)", "+ NEW=2", "- REMOVED=******", "  SAME=1"}},
+		// env files of older harp don't tell secrets
+		{nil, []string{"~ CHANGED=new (running: ******)", "+ NEW=2", "- REMOVED=******", "  SAME=1"}},
+	} {
+		if got := envDiff(want, running, deployed, c.secrets); !reflect.DeepEqual(got, c.lines) {
+			t.Errorf("envDiff with secrets %v = %q; want %q", c.secrets, got, c.lines)
+		}
+	}
+}
@@ -5,23 +5,18 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"runtime/debug"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
-	"time"
-
-	"github.com/DisposaBoy/JsonConfigReader"
 )
 
 // TODOs
@@ -40,8 +35,8 @@ import (
 // 	pwd/.harp/migration
 //
 // server
-// 	$GOPATH/bin
-// 	$GOPATH/src
+// 	$GOPATH/bin (or $AppDir/bin)
+// 	$GOPATH/src (or $AppDir)
 // 	$HOME/harp/$APP/build.$num.tar.gz
 // 	$HOME/harp/$APP/pid
 // 	$HOME/harp/$APP/log
@@ -57,15 +52,42 @@ func init() {
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		for range c {
+			interruptMutex.Lock()
+			handler := interruptHandler
+			interruptMutex.Unlock()
+			if handler != nil {
+				handler()
+				continue
+			}
 			cleanCaches()
+			removeRuntimeDir()
 			os.Exit(0)
 		}
 	}()
 }
 
+var (
+	interruptMutex   sync.Mutex
+	interruptHandler func()
+)
+
+// onInterrupt lets fn handle Ctrl-C instead of quitting harp, until the
+// returned function is called.
+func onInterrupt(fn func()) (restore func()) {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	old := interruptHandler
+	interruptHandler = fn
+	return func() {
+		interruptMutex.Lock()
+		defer interruptMutex.Unlock()
+		interruptHandler = old
+	}
+}
+
 type Config struct {
 	GOOS, GOARCH string
 
@@ -75,6 +97,40 @@ type Config struct {
 	// TODO
 	BuildVersionCmd string
 
+	// SSHConfig is the OpenSSH client config file harp honors.
+	// Default: ~/.ssh/config. "none" disables it.
+	SSHConfig string
+
+	// KnownHosts is a project known_hosts file checked before
+	// ~/.ssh/known_hosts, where harp also saves keys trusted in tofu mode.
+	KnownHosts string
+	// HostKeyCheck is one of strict (default), tofu (ask to trust unknown
+	// hosts) and off.
+	HostKeyCheck string
+
+	// ConnectTimeout limits tcp connection and ssh handshake, default 10s.
+	// CommandTimeout limits remote commands except for log tailing and
+	// migrations, no limit by default. KeepAlive is the interval of
+	// keepalive requests, default 30s (ServerAliveInterval in ssh config
+	// takes precedence), 0 disables it. All in Go duration format.
+	ConnectTimeout string
+	CommandTimeout string
+	KeepAlive      string
+	// ConnectRetries is the number of retries on transient connection
+	// errors, default 2. Negative value disables retry.
+	ConnectRetries int
+
+	// Parallel is the max number of servers operated concurrently, which
+	// could be overridden by -parallel. Default: no limit.
+	Parallel int
+
+	// Secrets are values encrypted by harp secret set, which could be
+	// referenced in Envs as "secret:name". SecretKeyFile is the local key
+	// file, default: harp.key next to harp.json. HARP_SECRET_KEY takes
+	// precedence over it.
+	Secrets       map[string]string
+	SecretKeyFile string
+
 	// LogDir string `json:"log_dir"`
 
 	// TODO: multiple instances support
@@ -89,12 +145,56 @@ type Config struct {
 	// }
 
 	Servers map[string][]*Server
+
+	// ServerSets contains settings shared by servers in the same set, keyed by
+	// server set name.
+	ServerSets map[string]*ServerSet
+
+	// Defaults are settings inherited by all servers, see ServerSet.Defaults.
+	Defaults *Server
+}
+
+// ServerSet holds settings applied to all servers of a server set. Settings
+// specified in Server take precedence.
+type ServerSet struct {
+	GOOS, GOARCH string
+	BuildArgs    string
+	BuildTags    string
+
+	// Proxy is the bastion host (chain) of servers in the set.
+	Proxy *Server
+
+	// Inventory lists servers of the set by a command or a file, in
+	// addition to the ones in Servers.
+	Inventory *Inventory
+
+	// Sets composes the set of other server sets. Servers keep settings of
+	// their own sets.
+	Sets []string
+
+	// Envs of servers in the set, overriding App.Envs and Defaults.Envs
+	// (of the config and the set), and overridden by Server.Envs.
+	Envs map[string]string
+
+	// Defaults are settings inherited by servers in the set (e.g. User,
+	// Port, GoPath and Envs), taking precedence over Config.Defaults.
+	Defaults *Server
+
+	// Overrides of deployment settings in Config and App.
+	NoRollback    *bool
+	RollbackCount int
+	KillSig       string
 }
 
 type App struct {
 	Name       string
 	ImportPath string
 
+	// AppDir is where the binary, files and harp-build.info are installed
+	// on servers, replacing $GOPATH/bin and $GOPATH/src/$ImportPath.
+	// Could be overridden by Server.AppDir.
+	AppDir string
+
 	NoRelMatch       bool
 	DefaultExcludeds []string
 	Files            []File
@@ -105,8 +205,15 @@ type App struct {
 	BuildCmd  string
 	BuildArgs string
 
+	// BuildInfoVar is a string variable (e.g. main.buildInfo) harp sets with
+	// build info in json by -ldflags -X.
+	BuildInfoVar string
+
 	KillSig string
 
+	// LogRotate enables rotation of app.log.
+	LogRotate *LogRotate
+
 	// Default: 1MB
 	FileWarningSize int64
 
@@ -137,10 +244,11 @@ func (t *FlagStrings) Set(s string) error {
 var (
 	// option is a global control center, keeping flags in one place.
 	option = struct {
-		configPath string
+		configPath  string // the first config file, where secrets are saved
+		configPaths FlagStrings
 
-		debug bool
-		// verbose   bool
+		debug   bool
+		verbose bool
 
 		noBuild  bool
 		noUpload bool
@@ -155,10 +263,14 @@ var (
 		tailBeginLineNum int
 
 		syncFileLimit int
+		parallel      int
 
 		// TODO: can specify a single server, instead of the whole server set
 		servers    FlagStrings
 		serverSets FlagStrings
+		envs       FlagStrings
+		selects    FlagStrings
+		excludes   FlagStrings
 		help       bool
 		version    bool
 
@@ -166,6 +278,8 @@ var (
 
 		all bool
 
+		refreshInventory bool
+
 		deploy string
 
 		tasks Tasks
@@ -195,9 +309,10 @@ var (
 var tmpDir = ".harp"
 
 func main() {
-	flag.StringVar(&option.configPath, "c", "harp.json", "config file path")
+	flag.Var(&option.configPaths, "c", "config file path (json, yaml or toml), multiple files are merged in order (default harp.json, harp.yaml, harp.yml or harp.toml)")
 
 	flag.BoolVar(&option.debug, "debug", false, "print debug info")
+	flag.BoolVar(&option.verbose, "verbose", false, "print more details (e.g. full build info of every server in info)")
 
 	flag.BoolVar(&option.noBuild, "nb", false, "no build")
 	flag.BoolVar(&option.noBuild, "no-build", false, "no build")
@@ -231,10 +346,16 @@ func main() {
 	flag.Var(&option.serverSets, "server-set", "specify server sets to deploy, multiple sets are split by comma")
 
 	flag.Var(&option.servers, "server", "specify servers to deploy, multiple servers are split by comma")
+	flag.Var(&option.selects, "select", "select servers by tags (e.g. 'region=eu,role!=cron', also key and !key), from the specified sets/servers or all servers, multiple selectors are ORed")
+	flag.Var(&option.excludes, "exclude", "exclude servers by ID or User@Host:Port, multiple servers are split by comma")
+
+	flag.Var(&option.envs, "e", "set environment variable (KEY=VALUE) of the app for deploy, restart and migrations, overriding the ones in config, could be specified multiple times (saved in the env file on servers by deploy and restart)")
 
 	flag.BoolVar(&option.all, "all", false, "execute action on all server")
+	flag.BoolVar(&option.refreshInventory, "refresh-inventory", false, "ignore cached outputs of inventory commands")
 
 	flag.IntVar(&option.syncFileLimit, "sync-queue-size", 5, "set file syncing queue size.")
+	flag.IntVar(&option.parallel, "parallel", 0, "max number of servers operated concurrently, 0 means no limit (default: Parallel in config)")
 
 	flag.StringVar(&option.deploy, "deploy", "", "deploy app to servers/sets")
 
@@ -248,6 +369,12 @@ func main() {
 	flag.BoolVar(&option.force, "f", false, "force harp to deploy. ingore version checking")
 
 	flag.Parse()
+	defer removeRuntimeDir()
+
+	if len(option.configPaths) == 0 {
+		option.configPaths = FlagStrings{defaultConfigPath()}
+	}
+	option.configPath = option.configPaths[0]
 
 	if option.debug {
 		log.SetFlags(log.Lshortfile)
@@ -280,10 +407,33 @@ func main() {
 		return
 	}
 
-	if option.transient {
+	switch action {
+	case "validate":
+		validateCmd()
+		return
+	case "config":
+		configCmd(args[1:])
+		return
+	}
+
+	switch {
+	case option.transient:
 		cfg.App.Name = "harp"
-	} else {
-		cfg = parseCfg(option.configPath)
+	case action == "secret" || action == "servers":
+		// they work without environment variables referenced by the
+		// config, e.g. setting secrets on a machine without them
+		cfg = parseCfgChecked(option.configPaths, interpolateChecks{})
+	default:
+		cfg = parseCfg(option.configPaths...)
+	}
+
+	switch action {
+	case "secret":
+		secretCmd(args[1:])
+		return
+	case "servers":
+		listServers(args[1:])
+		return
 	}
 
 	var servers []*Server
@@ -307,15 +457,19 @@ func main() {
 			os.Exit(1)
 		}
 		migrate(servers, migrations)
-	case "info", "status":
+	case "info":
 		info(servers)
+	case "status":
+		status(servers)
 	case "log":
-		option.toTailLog = true
+		logCmd(servers, args[1:])
 	case "restart":
 		// option.noBuild = true
 		// option.noUpload = true
 		// deploy(servers)
 		restart(servers)
+	case "env":
+		printEnvs(servers)
 	case "inspect":
 		inspectScript(servers, args[1])
 	case "rollback":
@@ -343,7 +497,33 @@ func main() {
 		// 		exitf("os.RemoveAll(%s) error: %s", tmpDir, err)
 		// 	}
 		// }
-		tailLog(servers, option.tailBeginLineNum)
+		tailLog(servers, logOptions{follow: true, lines: option.tailBeginLineNum})
+	}
+}
+
+var (
+	runtimeDirOnce sync.Once
+	runtimeDirPath string
+)
+
+// runtimeDir returns a private temporary directory for files that shouldn't
+// outlive harp, like the socket of harp agent and verified host keys. Unlike
+// .harp, it's not shared by other harp processes.
+func runtimeDir() string {
+	runtimeDirOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "harp")
+		if err != nil {
+			exitf("failed to create runtime dir: %s", err)
+		}
+		runtimeDirPath = dir
+	})
+	return runtimeDirPath
+}
+
+func removeRuntimeDir() {
+	if runtimeDirPath != "" {
+		os.RemoveAll(runtimeDirPath)
+		runtimeDirPath, runtimeDirOnce = "", sync.Once{}
 	}
 }
 
@@ -360,65 +540,64 @@ func initTmpDir() func() {
 func deploy(servers []*Server) {
 	defer initTmpDir()()
 
-	info := getBuildLog()
+	targets := retrieveBuildTargets(servers, false)
+	infos := map[buildTarget]string{}
+	for _, t := range targets {
+		infos[t] = currentBuildInfo().withTarget(t).marshal()
+	}
 	if !option.noBuild {
 		log.Println("building")
-		build()
+		buildAll(targets)
 	}
 
 	if !option.noUpload {
 		syncFiles()
 	}
 
-	var wg sync.WaitGroup
-	for _, server := range servers {
-		wg.Add(1)
-		go func(server *Server) {
-			defer wg.Done()
-
-			// check harp version
-			if err := server.checkHarpVersion(); err != nil {
-				if option.force {
-					fmt.Fprintf(os.Stderr, err.Error()+"\n")
-				} else {
-					exitf(err.Error() + "\n")
-				}
-			}
-
-			if !option.noUpload {
-				diff := server.diffFiles()
-				if diff != "" {
-					diff = "diff: \n" + diff
-				}
-				log.Printf("uploading: [%s] %s\n%s", server.Set, server, diff)
-				server.upload(info)
+	eachServer(servers, func(_ int, server *Server) {
+		// check harp version
+		if err := server.checkHarpVersion(); err != nil {
+			if option.force {
+				fmt.Fprintln(os.Stderr, err.Error())
+			} else {
+				exitf(err.Error() + "\n")
 			}
+		}
 
-			if !option.noDeploy {
-				log.Printf("deploying: [%s] %s\n", server.Set, server)
-				server.deploy()
+		if !option.noUpload {
+			diff := server.diffFiles()
+			if diff != "" {
+				diff = "diff: \n" + diff
 			}
-		}(server)
-	}
+			log.Printf("uploading: [%s] %s\n%s", server.Set, server, diff)
+			server.upload(infos[server.buildTarget()])
+		}
 
-	wg.Wait()
+		if !option.noDeploy {
+			log.Printf("deploying: [%s] %s\n", server.Set, server)
+			server.deploy()
+		}
+	})
 }
 
 func (s *Server) checkHarpVersion() error {
-	output, err := s.getBuildInfo()
+	bi, err := s.getBuildInfo()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[%s] getBuildInfo(): %s\n", s, err)
 		return nil
 	}
-	matches := regexp.MustCompile(harpVersionPrefix + "([0-9\\.]+)\n").FindStringSubmatch(output)
-	if len(matches) != 2 {
+	if bi.HarpVersion == "" {
 		fmt.Fprintf(os.Stderr, "[%s] failed to retrieve harp version\n", s)
 		return nil
 	}
-	old := strings.Split(matches[1], ".")
+	old := strings.Split(bi.HarpVersion, ".")
 	cur := strings.Split(getVersion(), ".")
+	if len(old) != 3 {
+		fmt.Fprintf(os.Stderr, "[%s] unknown harp version: %s\n", s, bi.HarpVersion)
+		return nil
+	}
 	if cmpver(old[0], cur[0]) > 0 || cmpver(old[1], cur[1]) > 0 || cmpver(old[2], cur[2]) > 0 {
-		return fmt.Errorf("server %s is deployed by harp version %s; your harp version is %s, please upgrade harp or skip harp version checking by flag -f", s, matches[1], getVersion())
+		return fmt.Errorf("server %s is deployed by harp version %s; your harp version is %s, please upgrade harp or skip harp version checking by flag -f", s, bi.HarpVersion, getVersion())
 	}
 	return nil
 }
@@ -429,42 +608,27 @@ func cmpver(v1, v2 string) int {
 	return i1 - i2
 }
 
-func info(servers []*Server) {
-	var wg sync.WaitGroup
-	for _, serv := range servers {
-		wg.Add(1)
-		go func(serv *Server) {
-			defer wg.Done()
-			serv.initPathes()
-			output, err := serv.getBuildInfo()
-			if err != nil {
-				exitf("failed to cat %s.info on %s: %s(%s)", cfg.App.Name, serv, err, output)
-			}
-			fmt.Printf("=====\n%s\n%s", serv.String(), output)
-		}(serv)
-	}
-	wg.Wait()
-}
-
-func (s *Server) getBuildInfo() (string, error) {
-	session := s.getSession()
-	output, err := session.CombinedOutput(fmt.Sprintf(
-		"cat %s/src/%s/harp-build.info",
-		s.GoPath, cfg.App.ImportPath,
-	))
-	return string(output), err
+// parseCfg parses and merges config files in order (see loadConfig), and
+// resolves variables in values (see interpolateConfig).
+func parseCfg(configPaths ...string) Config {
+	return parseCfgChecked(configPaths, interpolateChecks{envs: true})
 }
 
-func parseCfg(configPath string) (cfg Config) {
-	var r io.Reader
-	r, err := os.OpenFile(configPath, os.O_RDONLY, 0644)
-	if err != nil {
-		if os.IsNotExist(err) {
-			exitf("Config %s doesn't exist or is unspecified.\nTo specify with flag -c (e.g. -c harp.json)", configPath)
+// parseCfgChecked is parseCfg with checks of variables.
+func parseCfgChecked(configPaths []string, checks interpolateChecks) (cfg Config) {
+	conf := loadConfig(configPaths)
+	if issues := interpolateConfig(conf, checks); len(issues) > 0 {
+		var msgs []string
+		for _, issue := range issues {
+			msgs = append(msgs, issue.String())
 		}
-		exitf("failed to read config: %s", err)
+		exitf("failed to parse config:\n%s", strings.Join(msgs, "\n"))
 	}
-	if err := json.NewDecoder(JsonConfigReader.New(r)).Decode(&cfg); err != nil {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		exitf("failed to parse config: %s", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
 		exitf("failed to parse config: %s", err)
 	}
 
@@ -474,7 +638,7 @@ func parseCfg(configPath string) (cfg Config) {
 
 	for k, set := range cfg.Servers {
 		for _, s := range set {
-			s.Set = k
+			cfg.setUpServer(s, k)
 		}
 	}
 
@@ -482,6 +646,16 @@ func parseCfg(configPath string) (cfg Config) {
 		cfg.RollbackCount = 3
 	}
 
+	switch cfg.HostKeyCheck {
+	case "", hostKeyStrict, hostKeyTOFU, hostKeyOff:
+	default:
+		exitf("unknown HostKeyCheck %q, supported: %s, %s and %s", cfg.HostKeyCheck, hostKeyStrict, hostKeyTOFU, hostKeyOff)
+	}
+
+	parseDuration("ConnectTimeout", cfg.ConnectTimeout, 0)
+	parseDuration("CommandTimeout", cfg.CommandTimeout, 0)
+	parseDuration("KeepAlive", cfg.KeepAlive, 0)
+
 	cfg.App.DefaultExcludeds = append(cfg.App.DefaultExcludeds, ".harp/")
 
 	if cfg.App.FileWarningSize == 0 {
@@ -491,28 +665,14 @@ func parseCfg(configPath string) (cfg Config) {
 	return
 }
 
-const harpVersionPrefix = "Harp Version: "
-
-func getBuildLog() string {
-	var info string
-	info += "Go Version: " + cmd("go", "version")
-	if cfg.GOOS != "" {
-		info += "GOOS: " + cfg.GOOS + "\n"
+// setUpServer adds s to the server set, inheriting Defaults of the set and
+// the config.
+func (c *Config) setUpServer(s *Server, set string) {
+	s.Set = set
+	if set := c.ServerSets[set]; set != nil {
+		s.inherit(set.Defaults)
 	}
-	if cfg.GOARCH != "" {
-		info += "GOARCH: " + cfg.GOARCH + "\n"
-	}
-
-	info += harpVersionPrefix + getVersion() + "\n"
-
-	vcs, checksum := retrieveChecksum()
-	info += vcs + " Checksum: " + checksum + "\n"
-
-	info += "Composer: " + retrieveAuthor() + "\n"
-
-	info += "Build At: " + time.Now().String()
-
-	return info
+	s.inherit(c.Defaults)
 }
 
 func retrieveChecksum() (vcs, checksum string) {
@@ -557,9 +717,14 @@ func isUsingGit() bool {
 }
 
 func cmd(name string, args ...string) string {
+	return cmdEnv([]string{"GOOS=" + cfg.GOOS, "GOARCH=" + cfg.GOARCH}, name, args...)
+}
+
+// cmdEnv is similar to cmd, but allows specifying extra environment variables.
+func cmdEnv(env []string, name string, args ...string) string {
 	cmd := exec.Command(name, args...)
 	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "GOOS="+cfg.GOOS, "GOARCH="+cfg.GOARCH)
+	cmd.Env = append(cmd.Env, env...)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -582,38 +747,15 @@ func tryCmd(name string, args ...string) string {
 	return string(output)
 }
 
-func build() {
-	app := cfg.App
-
-	boutput := filepath.Join(tmpDir, app.Name)
-	ba := cfg.App.BuildArgs
-	if ba == "" {
-		ba = "-a -v"
-	}
-	if option.buildArgs != "" {
-		ba = option.buildArgs
-	}
-	buildCmd := fmt.Sprintf("go build %s -o %s %s", ba, boutput, app.ImportPath)
-	if app.BuildCmd != "" {
-		buildCmd = fmt.Sprintf(app.BuildCmd, boutput, app.ImportPath)
-	}
-	if option.debug {
-		println("build cmd:", buildCmd)
-	}
-	output := cmd("sh", "-c", buildCmd)
-	if option.debug {
-		print(output)
-	}
-}
-
 func exitf(format string, args ...interface{}) {
 	if !strings.HasSuffix(format, "\n") {
 		format += "\n"
 	}
-	fmt.Fprintf(os.Stderr, format, args...)
+	fmt.Fprint(os.Stderr, redact(fmt.Sprintf(format, args...)))
 	if option.debug {
 		debug.PrintStack()
 	}
+	removeRuntimeDir()
 	os.Exit(1)
 }
 
@@ -626,10 +768,23 @@ actions:
     deploy   Deploy your application (e.g. harp -s prod deploy).
     run      Run migrations on server (e.g. harp -s prod migrate path/to/my_migration.go).
     kill     Kill server.
-    info     Print build info of servers (e.g. harp -s prod info). Alias: status.
-    log      Print real time logs of application (e.g. harp -s prod log).
+    info     Print build info of servers and drifts in server sets (e.g. harp -s prod info).
+    status   Print process status (uptime, cpu, memory, ports, etc.) of application (e.g. harp -s prod status).
+    log      Print real time logs of application (e.g. harp -s prod log), see harp log -h for filters and other modes.
+        fetch -o $dir      Download app.log, history.log and rotated logs into $dir/$set/$server/ (e.g. harp -s prod log fetch -o incident -since 2h).
     restart  Restart application (e.g. harp -s prod restart).
+    env      Print effective environment variables of the app and diff against the running ones (e.g. harp -s prod env).
+    servers
+        ls       List servers of server sets, including the ones from inventories, without connecting to them (all servers if no -s or -server).
     init     Initialize a harp.json file.
+    validate Check config files: syntax, unknown keys, required fields, Files, script templates, etc.
+    config
+        show [$format]     Print the merged config of all the -c files, Extends and Include (json, yaml or toml).
+        convert $src $dst  Translate config file between formats by extensions (e.g. harp config convert harp.json harp.yaml).
+    secret
+        set $name [$value] Encrypt and save a secret in harp.json (value is read from terminal or stdin if omitted).
+        get $name          Print a decrypted secret.
+        edit               Edit all the secrets in $EDITOR.
     rollback
         ls       List all the current releases. Alias: l, list.
         $version Rollback to $version.
@@ -638,6 +793,8 @@ actions:
     	restart
     	kill
     	rollback
+    	status
+    	env
     	files
 
 options:`)
@@ -660,61 +817,26 @@ examples:
 }
 
 func retrieveServers() []*Server {
-	serverSets := option.serverSets
-	servers := option.servers
-
-	if option.all {
-		serverSets = []string{}
-		for set, _ := range cfg.Servers {
-			serverSets = append(serverSets, set)
-		}
-	}
-
-	if len(servers) == 0 && len(serverSets) == 0 {
-		println("please specify servers or server sets to deploy (-s or -server).")
-		println("specify -all flag to execute the action on all servers.")
-		os.Exit(1)
-	}
-
-	var targetServers []*Server
-	for _, set := range serverSets {
-		servers, ok := cfg.Servers[set]
-		if !ok {
-			var existings []string
-			for s, _ := range cfg.Servers {
-				existings = append(existings, s)
-			}
-			sort.Sort(sort.StringSlice(existings))
-			fmt.Printf("server set doesn't exist: %s (%s)\n", set, strings.Join(existings, ", "))
-			os.Exit(1)
-		}
-		targetServers = append(targetServers, servers...)
+	targetServers := selectServers()
+	if !testMode {
+		initServers(targetServers)
 	}
 
-serversLoop:
-	for _, server := range servers {
-		for _, set := range cfg.Servers {
-			for _, s := range set {
-				if server == s.String() || server == s.ID {
-					targetServers = append(targetServers, s)
-					continue serversLoop
-				}
-			}
-		}
-
-		// one-shot servers
-		if s := newOneShotServer(server); s != nil {
-			targetServers = append(targetServers, newOneShotServer(server))
-		} else {
-			exitf("wrong url format (eg: name@host:port): %s", server)
-		}
-	}
+	return targetServers
+}
 
-	for _, s := range targetServers {
+// initServers initializes servers, and connects them concurrently if there
+// is no -parallel limit. With a limit, servers are connected on demand in
+// the limited slots of actions, rather than connected twice.
+func initServers(servers []*Server) {
+	// resolving is local and might share proxies between servers, so it's
+	// done before connecting servers concurrently.
+	for _, s := range servers {
 		s.init()
 	}
-
-	return targetServers
+	if parallelLimit() == 0 {
+		eachServer(servers, func(int, *Server) {})
+	}
 }
 
 func initHarp() {
@@ -768,13 +890,21 @@ func inspectScript(servers []*Server, name string) {
 		fmt.Println("#", s.String())
 		switch name {
 		case "deploy":
-			fmt.Println(s.retrieveDeployScript())
+			fmt.Println(redact(s.retrieveDeployScript()))
 		case "restart":
-			fmt.Println(s.retrieveRestartScript(retrieveAuthor()))
+			fmt.Println(redact(s.retrieveRestartScript(retrieveAuthor())))
 		case "kill":
-			fmt.Println(s.retrieveKillScript(retrieveAuthor()))
+			fmt.Println(redact(s.retrieveKillScript(retrieveAuthor())))
 		case "rollback":
-			fmt.Println(s.retrieveRollbackScript())
+			fmt.Println(redact(s.retrieveRollbackScript()))
+		case "status":
+			fmt.Println(redact(s.retrieveStatusScript()))
+		case "env":
+			content, err := envFile(s.appEnvs())
+			if err != nil {
+				exitf("failed to generate env file: %s", err)
+			}
+			fmt.Print(redact(content))
 		default:
 			exitf("unknown script: %s\n", name)
 		}
@@ -782,22 +912,15 @@ func inspectScript(servers []*Server, name string) {
 }
 
 func kill(servers []*Server) {
-	var wg sync.WaitGroup
-	for _, server := range servers {
-		wg.Add(1)
-		go func(s *Server) {
-			defer func() { wg.Done() }()
-
-			session := s.getSession()
-			defer session.Close()
-			output, err := session.CombinedOutput(s.retrieveKillScript(retrieveAuthor()))
-			if err != nil {
-				exitf("failed to exec %s: %s %s", option.script, string(output), err)
-			}
-			log.Printf("%s killed\n", s)
-		}(server)
-	}
-	wg.Wait()
+	eachServer(servers, func(_ int, s *Server) {
+		session := s.getSession()
+		defer session.Close()
+		output, err := session.CombinedOutput(s.retrieveKillScript(retrieveAuthor()))
+		if err != nil {
+			exitf("failed to exec %s: %s %s", option.script, string(output), err)
+		}
+		log.Printf("%s killed\n", s)
+	})
 }
 
 var killScriptTmpl = template.Must(template.New("").Parse(`set -e
@@ -825,28 +948,22 @@ func (s *Server) retrieveKillScript(who string) string {
 		exitf(err.Error())
 	}
 	if option.debug {
-		fmt.Println(buf.String())
+		fmt.Println(redact(buf.String()))
 	}
 	return buf.String()
 }
 
 func restart(servers []*Server) {
-	var wg sync.WaitGroup
-	for _, server := range servers {
-		wg.Add(1)
-		go func(s *Server) {
-			defer func() { wg.Done() }()
-
-			session := s.getSession()
-			defer session.Close()
-			output, err := session.CombinedOutput(s.retrieveRestartScript(retrieveAuthor()))
-			if err != nil {
-				exitf("failed to exec %s: %s %s", option.script, string(output), err)
-			}
-			log.Printf("%s restarted\n", s)
-		}(server)
-	}
-	wg.Wait()
+	eachServer(servers, func(_ int, s *Server) {
+		s.saveEnvFile()
+		session := s.getSession()
+		defer session.Close()
+		output, err := session.CombinedOutput(s.retrieveRestartScript(retrieveAuthor()))
+		if err != nil {
+			exitf("failed to exec %s: %s %s", option.script, string(output), err)
+		}
+		log.Printf("%s restarted\n", s)
+	})
 }
 
 func initXC() {
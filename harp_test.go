@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func init() { testMode = true }
 
 func TestRetrieveServers(t *testing.T) {
 	cfg.Servers = map[string][]*Server{
@@ -52,3 +59,55 @@ func TestRetrieveServers(t *testing.T) {
 		}
 	}
 }
+
+func TestServerDefaults(t *testing.T) {
+	file, err := ioutil.TempFile("", "harp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"App": {"Name": "app", "KillSig": "TERM"},
+		"RollbackCount": 5,
+		"Defaults": {"User": "app", "Port": ":22", "Envs": {"A": "global", "B": "global"}},
+		"ServerSets": {
+			"staging": {
+				"RollbackCount": 1,
+				"NoRollback": false,
+				"KillSig": "INT",
+				"Envs": {"A": "set", "D": "set", "E": "set"},
+				"Defaults": {"Port": ":2222", "GoPath": "/go", "Envs": {"B": "set defaults", "C": "set defaults", "D": "set defaults"}}
+			}
+		},
+		"Servers": {
+			"staging": [{"Host": "s1", "Envs": {"C": "server", "E": "server"}}],
+			"prod": [{"Host": "p1", "User": "root"}]
+		}
+	}`)
+	file.Close()
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = parseCfg(file.Name())
+
+	staging, prod := cfg.Servers["staging"][0], cfg.Servers["prod"][0]
+	if got, want := staging.String(), "app@s1:2222"; got != want {
+		t.Errorf("staging = %s; want %s", got, want)
+	}
+	want := map[string]string{"GOPATH": "/go", "A": "set", "B": "set defaults", "C": "server", "D": "set", "E": "server"}
+	if got := staging.appEnvs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("staging envs = %v; want %v", got, want)
+	}
+	if got, want := prod.appEnvs(), map[string]string{"A": "global", "B": "global"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("prod envs = %v; want %v", got, want)
+	}
+	if staging.GoPath != "/go" || staging.rollbackCount() != 1 || staging.KillSig() != "INT" || staging.noRollback() {
+		t.Errorf("staging overrides are not applied: %+v", staging)
+	}
+	if got, want := prod.String(), "root@p1:22"; got != want {
+		t.Errorf("prod = %s; want %s", got, want)
+	}
+	if prod.GoPath != "" || prod.rollbackCount() != 5 || prod.KillSig() != "TERM" {
+		t.Errorf("prod settings are wrong: %+v", prod)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Host key checking modes, see Config.HostKeyCheck.
+const (
+	hostKeyStrict = "strict"
+	hostKeyTOFU   = "tofu"
+	hostKeyOff    = "off"
+)
+
+// knownHost is a line in known_hosts file (sshd(8)).
+type knownHost struct {
+	marker string // @cert-authority, @revoked or empty
+	hosts  string
+	key    ssh.PublicKey
+	file   string
+	line   int
+}
+
+// parseKnownHosts parses known_hosts file. Lines with key types unsupported
+// by harp are skipped.
+func parseKnownHosts(r io.Reader, file string) ([]knownHost, error) {
+	var hosts []knownHost
+	scanner := bufio.NewScanner(r)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		h := knownHost{file: file, line: lineNum}
+		if line[0] == '@' {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: missing host pattern", file, lineNum)
+			}
+			h.marker, line = fields[0], strings.TrimSpace(fields[1])
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: missing key", file, lineNum)
+		}
+		h.hosts = fields[0]
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1]))
+		if err != nil {
+			if option.debug {
+				log.Printf("%s:%d: skipped: %s\n", file, lineNum, err)
+			}
+			continue
+		}
+		h.key = key
+		hosts = append(hosts, h)
+	}
+	return hosts, scanner.Err()
+}
+
+// matches reports whether host (in form of knownHostName) matches the host
+// patterns, which could be hashed (|1|salt|hash) or comma separated patterns
+// with wildcards and negations.
+func (h knownHost) matches(host string) bool {
+	if strings.HasPrefix(h.hosts, "|1|") {
+		parts := strings.Split(h.hosts[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+	return sshConfigBlock{patterns: []string{h.hosts}}.matches(host)
+}
+
+// knownHostName returns host name used in known_hosts: host for port 22 and
+// [host]:port for the others.
+func knownHostName(host, port string) string {
+	port = strings.TrimLeft(port, ":")
+	if port == "" || port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// fingerprint returns SHA256 fingerprint of key, in the same format as
+// ssh-keygen -l.
+func fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+var knownHosts = struct {
+	sync.Mutex
+	loaded bool
+	hosts  []knownHost
+}{}
+
+// knownHostsFiles returns known_hosts files harp reads. The first one is
+// where harp saves trusted keys in tofu mode.
+func knownHostsFiles() []string {
+	var files []string
+	if cfg.KnownHosts != "" {
+		files = append(files, expandHome(cfg.KnownHosts))
+	}
+	return append(files, expandHome("~/.ssh/known_hosts"), "/etc/ssh/ssh_known_hosts")
+}
+
+// loadKnownHosts loads known_hosts files, should be called with knownHosts
+// locked. Missing files are empty, the project one is created by tofu.
+func loadKnownHosts() []knownHost {
+	if knownHosts.loaded {
+		return knownHosts.hosts
+	}
+	knownHosts.loaded = true
+	for _, path := range knownHostsFiles() {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			exitf("failed to open known_hosts: %s", err)
+		}
+		hosts, err := parseKnownHosts(file, path)
+		file.Close()
+		if err != nil {
+			exitf("failed to parse known_hosts: %s", err)
+		}
+		knownHosts.hosts = append(knownHosts.hosts, hosts...)
+	}
+	return knownHosts.hosts
+}
+
+// hostKeyAlgorithms returns key types of the server in known_hosts, so that
+// server presents the key harp knows. rsa keys are also offered with SHA-2
+// signatures, as ssh-rsa (SHA-1) is disabled by OpenSSH 8.8+.
+func (s *Server) hostKeyAlgorithms() []string {
+	if s.HostKey != "" || cfg.HostKeyCheck == hostKeyOff {
+		return nil
+	}
+	knownHosts.Lock()
+	defer knownHosts.Unlock()
+	name := knownHostName(s.hostAddr(), s.Port)
+	var algos []string
+	existings := map[string]bool{}
+	for _, h := range loadKnownHosts() {
+		if h.marker == "" && h.matches(name) && !existings[h.key.Type()] {
+			existings[h.key.Type()] = true
+			if h.key.Type() == ssh.KeyAlgoRSA {
+				algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+			}
+			algos = append(algos, h.key.Type())
+		}
+	}
+	return algos
+}
+
+// verifyHostKey checks host key against the pinned HostKey, or known_hosts
+// files in the mode of Config.HostKeyCheck.
+func (s *Server) verifyHostKey(_ string, _ net.Addr, key ssh.PublicKey) error {
+	name := knownHostName(s.hostAddr(), s.Port)
+	fp := fingerprint(key)
+
+	if s.HostKey != "" {
+		if strings.TrimRight(s.HostKey, "=") != fp {
+			return fmt.Errorf("host key of %s mismatches: got %s, want %s (HostKey)", name, fp, s.HostKey)
+		}
+		trustHostKey(name, key)
+		return nil
+	}
+
+	mode := firstNonEmpty(cfg.HostKeyCheck, hostKeyStrict)
+	if mode == hostKeyOff {
+		return nil
+	}
+
+	knownHosts.Lock()
+	defer knownHosts.Unlock()
+	var changed *knownHost
+	for _, h := range loadKnownHosts() {
+		if !h.matches(name) {
+			continue
+		}
+		switch {
+		case h.marker == "@revoked" && bytes.Equal(h.key.Marshal(), key.Marshal()):
+			return fmt.Errorf("host key %s of %s is revoked (%s:%d)", fp, name, h.file, h.line)
+		case h.marker != "":
+		case bytes.Equal(h.key.Marshal(), key.Marshal()):
+			trustHostKey(name, key)
+			return nil
+		case changed == nil:
+			h := h
+			changed = &h
+		}
+	}
+	if changed != nil {
+		return fmt.Errorf(
+			"REMOTE HOST IDENTIFICATION HAS CHANGED: host key of %s is %s %s, but %s %s is expected (%s:%d)",
+			name, key.Type(), fp, changed.key.Type(), fingerprint(changed.key), changed.file, changed.line,
+		)
+	}
+
+	if mode != hostKeyTOFU {
+		return fmt.Errorf(
+			"host key of %s is unknown (%s %s). Add it to known_hosts (e.g. ssh-keyscan -p %s -t ed25519,ecdsa,rsa %s >> ~/.ssh/known_hosts), pin it by HostKey, or use \"HostKeyCheck\": \"tofu\"",
+			name, key.Type(), fp, strings.TrimLeft(s.Port, ":"), s.hostAddr(),
+		)
+	}
+
+	answer, err := promptLine(fmt.Sprintf(
+		"The authenticity of host %s can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+		name, key.Type(), fp,
+	))
+	if err != nil {
+		return fmt.Errorf("host key of %s is unknown (%s %s) and couldn't be confirmed: %s", name, key.Type(), fp, err)
+	}
+	if answer != "yes" {
+		return errors.New("host key verification failed")
+	}
+	path := knownHostsFiles()[0]
+	if err := appendKnownHost(path, name, key); err != nil {
+		return err
+	}
+	log.Printf("added %s (%s) to %s\n", name, fp, path)
+	knownHosts.hosts = append(knownHosts.hosts, knownHost{hosts: name, key: key, file: path})
+	trustHostKey(name, key)
+	return nil
+}
+
+func appendKnownHost(path, name string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%s %s", name, ssh.MarshalAuthorizedKey(key)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+var trustedHostKeysMutex sync.Mutex
+
+// trustHostKey saves verified host key into known_hosts in runtime dir, which
+// is the only known_hosts of ssh commands started by harp (e.g. rsync).
+func trustHostKey(name string, key ssh.PublicKey) {
+	trustedHostKeysMutex.Lock()
+	defer trustedHostKeysMutex.Unlock()
+	if err := appendKnownHost(trustedHostKeysPath(), name, key); err != nil {
+		exitf("failed to save host key of %s: %s", name, err)
+	}
+}
+
+func trustedHostKeysPath() string { return filepath.Join(runtimeDir(), "known_hosts") }
+
+// hostKeySSHArgs returns ssh options that let OpenSSH accept only host keys
+// verified by harp.
+func hostKeySSHArgs() []string {
+	if cfg.HostKeyCheck == hostKeyOff {
+		return []string{"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null"}
+	}
+	return []string{
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + trustedHostKeysPath(),
+		"-o", "GlobalKnownHostsFile=/dev/null",
+	}
+}
+
+// promptLine reads a line from terminal.
+func promptLine(prompt string) (string, error) {
+	atomic.AddInt32(&prompting, 1)
+	defer atomic.AddInt32(&prompting, -1)
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+	if !isTerminal() {
+		return "", errors.New("stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(line), err
+}
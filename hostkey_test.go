@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestKnownHostMatches(t *testing.T) {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("[web.example.com]:2222"))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	for _, c := range []struct {
+		hosts, name string
+		want        bool
+	}{
+		{"web.example.com,10.0.0.1", "web.example.com", true},
+		{"web.example.com,10.0.0.1", "10.0.0.1", true},
+		{"web.example.com", "[web.example.com]:2222", false},
+		{"[web.example.com]:2222", "[web.example.com]:2222", true},
+		{"*.example.com,!db.example.com", "web.example.com", true},
+		{"*.example.com,!db.example.com", "db.example.com", false},
+		{hashed, "[web.example.com]:2222", true},
+		{hashed, "web.example.com", false},
+	} {
+		if got := (knownHost{hosts: c.hosts}).matches(c.name); got != c.want {
+			t.Errorf("%s matches %s = %t; want %t", c.hosts, c.name, got, c.want)
+		}
+	}
+
+	if got, want := knownHostName("web.example.com", ":22"), "web.example.com"; got != want {
+		t.Errorf("knownHostName = %s; want %s", got, want)
+	}
+	if got, want := knownHostName("web.example.com", ":2222"), "[web.example.com]:2222"; got != want {
+		t.Errorf("knownHostName = %s; want %s", got, want)
+	}
+}
+
+func TestVerifyHostKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer removeRuntimeDir()
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	known, changed, unknown, revoked := newTestHostKey(t), newTestHostKey(t), newTestHostKey(t), newTestHostKey(t)
+	path := filepath.Join(dir, "known_hosts")
+	content := "# comment\n" +
+		"web-1,web-2 " + string(ssh.MarshalAuthorizedKey(known)) +
+		"[web-3]:2222 " + string(ssh.MarshalAuthorizedKey(changed)) +
+		"@revoked * " + string(ssh.MarshalAuthorizedKey(revoked)) +
+		"web-4 ssh-unknown AAAA\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.KnownHosts = path
+	knownHosts.loaded, knownHosts.hosts = false, nil
+	defer func() { knownHosts.loaded, knownHosts.hosts = false, nil }()
+
+	for _, c := range []struct {
+		server Server
+		key    ssh.PublicKey
+		err    string
+	}{
+		{server: Server{Host: "web-2", Port: ":22"}, key: known},
+		{server: Server{Host: "web-3", Port: ":2222"}, key: known, err: "HAS CHANGED"},
+		{server: Server{Host: "web-3", Port: ":22"}, key: known, err: "is unknown"},
+		{server: Server{Host: "web-4", Port: ":22"}, key: unknown, err: "is unknown"},
+		{server: Server{Host: "web-1", Port: ":22"}, key: revoked, err: "revoked"},
+		{server: Server{Host: "web-5", Port: ":22", HostKey: fingerprint(unknown)}, key: unknown},
+		{server: Server{Host: "web-1", Port: ":22", HostKey: fingerprint(unknown)}, key: known, err: "mismatches"},
+	} {
+		err := c.server.verifyHostKey("", nil, c.key)
+		if c.err == "" && err != nil {
+			t.Errorf("%s: %s", c.server.Host, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: err = %v; want %q", c.server.Host, err, c.err)
+		}
+	}
+
+	web1 := Server{Host: "web-1", Port: ":22"}
+	if got, want := web1.hostKeyAlgorithms(), []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("hostKeyAlgorithms() = %q; want %q", got, want)
+	}
+
+	trusted, err := ioutil.ReadFile(trustedHostKeysPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "web-2 " + string(ssh.MarshalAuthorizedKey(known)) + "web-5 " + string(ssh.MarshalAuthorizedKey(unknown))
+	if string(trusted) != want {
+		t.Errorf("trusted host keys = %q; want %q", trusted, want)
+	}
+}
+
+func TestVerifyHostKeyTOFU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer removeRuntimeDir()
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	// confirms the unknown host key by stdin
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	w.WriteString("yes\n")
+	w.Close()
+	oldStdin, oldIsTerminal := os.Stdin, isTerminal
+	os.Stdin, isTerminal = stdin, func() bool { return true }
+	defer func() { os.Stdin, isTerminal = oldStdin, oldIsTerminal }()
+
+	// the project known_hosts is not created yet
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	path := filepath.Join(dir, "deploy", "known_hosts")
+	cfg.KnownHosts = path
+	cfg.HostKeyCheck = hostKeyTOFU
+	knownHosts.loaded, knownHosts.hosts = false, nil
+	defer func() { knownHosts.loaded, knownHosts.hosts = false, nil }()
+
+	key := newTestHostKey(t)
+	s := Server{Host: "web-1", Port: ":22"}
+	if err := s.verifyHostKey("", nil, key); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "web-1 " + string(ssh.MarshalAuthorizedKey(key)); string(content) != want {
+		t.Errorf("known_hosts = %q; want %q", content, want)
+	}
+	// trusted afterwards without asking again
+	if err := s.verifyHostKey("", nil, key); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// configVarRegexp matches ${NAME}, ${NAME:-default}, ${secret:name} and the
+// escaped form $${...}.
+var configVarRegexp = regexp.MustCompile(`\$?\$\{([^{}]*)\}`)
+
+// interpolateConfig resolves templates (e.g. {{.App.Name}}) and variables
+// (e.g. ${PROD_HOST}) in string values of the raw config, in place.
+//
+// Templates are executed first, with the config as data. Values in servers
+// (and Defaults and proxies) could also reference settings of the server,
+// including the ones inherited from Defaults, e.g. {{.Home}}. Then ${NAME}
+// is replaced by environment variable NAME, or the default in ${NAME:-def}.
+// ${secret:name} is kept for revealing secrets on use, and only allowed in
+// Envs and Password.
+//
+// Undefined environment variables (kept as they are if unchecked) and
+// missing secrets are only reported if they are checked. Missing secrets
+// are only checked by harp validate, as they are reported on use anyway,
+// and harp secret set should work for secrets referenced but not set yet.
+func interpolateConfig(conf map[string]interface{}, checks interpolateChecks) (issues []configIssue) {
+	var secrets map[string]interface{}
+	if checks.secrets {
+		secrets, _ = conf["Secrets"].(map[string]interface{})
+		if secrets == nil {
+			secrets = map[string]interface{}{}
+		}
+	}
+	var walk func(val interface{}, path []string, data map[string]interface{}) interface{}
+	walk = func(val interface{}, path []string, data map[string]interface{}) interface{} {
+		switch v := val.(type) {
+		case string:
+			str, err := interpolateString(v, path, data, secrets, checks.envs)
+			if err != nil {
+				issues = append(issues, configIssue{path: strings.Join(path, "."), msg: err.Error()})
+				return v
+			}
+			return str
+		case map[string]interface{}:
+			if isServerConfigPath(path) {
+				data = serverConfigData(conf, data, path, v)
+			}
+			for k, e := range v {
+				v[k] = walk(e, appendPath(path, k), data)
+			}
+		case []interface{}:
+			for i, e := range v {
+				v[i] = walk(e, appendPath(path, strconv.Itoa(i)), data)
+			}
+		}
+		return val
+	}
+	walk(conf, nil, conf)
+	sort.Slice(issues, func(i, j int) bool { return issues[i].path < issues[j].path })
+	return
+}
+
+// interpolateChecks are checks of interpolateConfig.
+type interpolateChecks struct {
+	envs    bool // environment variables are defined
+	secrets bool // referenced secrets exist in Secrets
+}
+
+func appendPath(path []string, key string) []string {
+	return append(append([]string{}, path...), key)
+}
+
+// isServerConfigPath reports whether path is a server object: Defaults,
+// ServerSets.*.Defaults, ServerSets.*.Proxy, Servers.*.N and their Proxy.
+func isServerConfigPath(path []string) bool {
+	switch {
+	case len(path) == 0:
+		return false
+	case path[len(path)-1] == "Proxy":
+		return true
+	case len(path) == 1:
+		return path[0] == "Defaults"
+	case len(path) == 3:
+		return (path[0] == "ServerSets" && path[2] == "Defaults") || path[0] == "Servers"
+	}
+	return false
+}
+
+// serverConfigData returns template data of values in a server: the config
+// overlaid by global Defaults, Defaults of the server set and the server.
+func serverConfigData(conf, parent map[string]interface{}, path []string, server map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+	overlay := func(m interface{}) {
+		if m, ok := m.(map[string]interface{}); ok {
+			for k, v := range m {
+				data[k] = v
+			}
+		}
+	}
+	overlay(parent)
+	if len(path) == 3 && path[0] == "Servers" {
+		overlay(conf["Defaults"])
+		if sets, ok := conf["ServerSets"].(map[string]interface{}); ok {
+			if set, ok := sets[path[1]].(map[string]interface{}); ok {
+				overlay(set["Defaults"])
+			}
+		}
+	}
+	overlay(server)
+	return data
+}
+
+var missingKeyRegexp = regexp.MustCompile(`map has no entry for key "([^"]*)"`)
+
+// interpolateString resolves templates and variables in str. Secrets are
+// checked if secrets isn't nil, undefined environment variables are errors if
+// checkEnvs.
+func interpolateString(str string, path []string, data, secrets map[string]interface{}, checkEnvs bool) (string, error) {
+	if strings.Contains(str, "{{") {
+		tmpl, err := template.New(strings.Join(path, ".")).Option("missingkey=error").Parse(str)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			if m := missingKeyRegexp.FindStringSubmatch(err.Error()); m != nil {
+				return "", fmt.Errorf("undefined config value %s in %s", m[1], str)
+			}
+			return "", err
+		}
+		str = buf.String()
+	}
+
+	var err error
+	str = configVarRegexp.ReplaceAllStringFunc(str, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := match[2 : len(match)-1]
+		if strings.HasPrefix(name, secretRefPrefix) {
+			secret := strings.TrimPrefix(name, secretRefPrefix)
+			field := path[len(path)-1]
+			if field != "Password" && (len(path) < 2 || path[len(path)-2] != "Envs") {
+				err = fmt.Errorf("secret %s could only be used in Envs and Password", secret)
+			} else if _, ok := secrets[secret]; !ok && secrets != nil {
+				err = fmt.Errorf("secret %s is not found in Secrets", secret)
+			}
+			return match
+		}
+		def, hasDef := "", false
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, def, hasDef = name[:i], name[i+2:], true
+		}
+		if val, ok := os.LookupEnv(name); ok && (val != "" || !hasDef) {
+			return val
+		}
+		if !hasDef {
+			if checkEnvs {
+				err = fmt.Errorf("environment variable %s is not defined", name)
+			}
+			return match
+		}
+		return def
+	})
+	return str, err
+}
+
+// revealSecretRefs replaces ${secret:name} in val by plaintexts.
+func revealSecretRefs(val string) string {
+	return configVarRegexp.ReplaceAllStringFunc(val, func(match string) string {
+		name := match[2 : len(match)-1]
+		if strings.HasPrefix(match, "$$") || !strings.HasPrefix(name, secretRefPrefix) {
+			return match
+		}
+		return revealSecret(name)
+	})
+}
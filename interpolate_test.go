@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestInterpolateConfig(t *testing.T) {
+	os.Setenv("HARP_TEST_HOST", "10.0.0.1")
+	defer os.Unsetenv("HARP_TEST_HOST")
+	os.Unsetenv("HARP_TEST_UNDEFINED")
+
+	conf := map[string]interface{}{
+		"App":      map[string]interface{}{"Name": "app"},
+		"Secrets":  map[string]interface{}{"db_dsn": "enc:v1:..."},
+		"Defaults": map[string]interface{}{"Home": "/home/app"},
+		"Servers": map[string]interface{}{
+			"prod": []interface{}{map[string]interface{}{
+				"Host":   "${HARP_TEST_HOST}",
+				"Port":   "${HARP_TEST_UNDEFINED:-:22}",
+				"LogDir": "{{.Home}}/logs/{{.App.Name}}",
+				"Envs": map[string]interface{}{
+					"DSN":   "${secret:db_dsn}",
+					"TOKEN": "${secret:token}",
+					"PID":   "$${PID}",
+					"USER":  "{{.User}}",
+				},
+			}},
+		},
+		"KnownHosts": "${HARP_TEST_UNDEFINED}",
+		"SSHConfig":  "${secret:db_dsn}",
+	}
+	issues := interpolateConfig(conf, interpolateChecks{envs: true, secrets: true})
+	var msgs []string
+	for _, issue := range issues {
+		msgs = append(msgs, issue.String())
+	}
+	wantMsgs := []string{
+		"KnownHosts: environment variable HARP_TEST_UNDEFINED is not defined",
+		"SSHConfig: secret db_dsn could only be used in Envs and Password",
+		"Servers.prod.0.Envs.TOKEN: secret token is not found in Secrets",
+		"Servers.prod.0.Envs.USER: undefined config value User in {{.User}}",
+	}
+	if !reflect.DeepEqual(msgs, wantMsgs) {
+		t.Errorf("issues = %q; want %q", msgs, wantMsgs)
+	}
+
+	server := conf["Servers"].(map[string]interface{})["prod"].([]interface{})[0].(map[string]interface{})
+	want := map[string]interface{}{
+		"Host":   "10.0.0.1",
+		"Port":   ":22",
+		"LogDir": "/home/app/logs/app",
+		"Envs": map[string]interface{}{
+			"DSN":   "${secret:db_dsn}",
+			"TOKEN": "${secret:token}",
+			"PID":   "${PID}",
+			"USER":  "{{.User}}",
+		},
+	}
+	if !reflect.DeepEqual(server, want) {
+		t.Errorf("server = %v; want %v", server, want)
+	}
+}
+
+// TestInterpolateUnchecked makes sure secrets referenced but not set yet
+// don't break loading, and undefined environment variables don't break harp
+// secret.
+func TestInterpolateUnchecked(t *testing.T) {
+	os.Unsetenv("HARP_TEST_HOST")
+	file, err := ioutil.TempFile("", "harp.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"App": {"Name": "app", "Envs": {"DSN": "${secret:db_dsn}"}},
+		"Servers": {"prod": [{"Host": "${HARP_TEST_HOST}"}]}
+	}`)
+	file.Close()
+
+	conf := parseCfgChecked([]string{file.Name()}, interpolateChecks{})
+	if got := conf.Servers["prod"][0].Host; got != "${HARP_TEST_HOST}" {
+		t.Errorf("Host = %q", got)
+	}
+
+	os.Setenv("HARP_TEST_HOST", "10.0.0.1")
+	defer os.Unsetenv("HARP_TEST_HOST")
+	conf = parseCfg(file.Name())
+	if got := conf.App.Envs["DSN"]; got != "${secret:db_dsn}" {
+		t.Errorf("DSN = %q", got)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Inventory defines servers of a server set outside of harp config, for
+// hosts managed elsewhere, e.g. by cloud inventories. Servers listed in it
+// are appended to the ones in Servers, and inherit Defaults like them.
+type Inventory struct {
+	// Cmd is a shell command printing servers in JSON, either a list of
+	// servers or an object with a Servers list, e.g.
+	// [{"ID": "web-1", "Host": "10.0.1.2", "User": "app"}].
+	Cmd string
+	// File is an inventory file in json, yaml or toml, in the same format
+	// as outputs of Cmd (yaml and toml ones need the Servers key).
+	File string
+	// TTL is how long outputs of Cmd are cached (e.g. 10m), default: no
+	// caching. Flag -refresh-inventory ignores caches.
+	TTL string
+}
+
+// inventoryLoaded records server sets whose inventories are loaded.
+var inventoryLoaded = map[string]bool{}
+
+// serverSetNames returns sorted names of all server sets, including the
+// ones defined only by inventories or other sets.
+func serverSetNames() []string {
+	names := sortedSetNames(cfg.Servers)
+	for name, set := range cfg.ServerSets {
+		if _, ok := cfg.Servers[name]; !ok && set != nil && (set.Inventory != nil || len(set.Sets) > 0) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadInventories appends servers in inventories of the server sets to
+// cfg.Servers. Inventories are loaded only once.
+func loadInventories(sets []string) {
+	for _, name := range sets {
+		set := cfg.ServerSets[name]
+		if inventoryLoaded[name] || set == nil || set.Inventory == nil {
+			continue
+		}
+		inventoryLoaded[name] = true
+		servers, source, err := set.Inventory.load()
+		if err != nil {
+			exitf("failed to load inventory of server set %s: %s", name, err)
+		}
+		for i, s := range servers {
+			if s == nil || s.Host == "" {
+				exitf("inventory of server set %s (%s): server %d has no Host", name, source, i)
+			}
+			s.source = source
+			cfg.setUpServer(s, name)
+		}
+		if cfg.Servers == nil {
+			cfg.Servers = map[string][]*Server{}
+		}
+		cfg.Servers[name] = append(cfg.Servers[name], servers...)
+	}
+}
+
+// load returns servers in the inventory and where they are from.
+func (inv *Inventory) load() (servers []*Server, source string, err error) {
+	switch {
+	case inv.Cmd != "" && inv.File != "":
+		return nil, "", errors.New("only one of Cmd and File could be specified")
+	case inv.File != "":
+		data, err := ioutil.ReadFile(inv.File)
+		if err != nil {
+			return nil, "", err
+		}
+		servers, err = parseInventory(configFormat(inv.File), data)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %s", inv.File, err)
+		}
+		return servers, "inventory " + inv.File, nil
+	case inv.Cmd == "":
+		return nil, "", errors.New("Cmd or File is required")
+	}
+
+	ttl, err := time.ParseDuration(firstNonEmpty(inv.TTL, "0s"))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse TTL: %s", err)
+	}
+	cache := inventoryCachePath(inv.Cmd)
+	if fi, err := os.Stat(cache); err == nil && ttl > 0 && !option.refreshInventory {
+		if age := time.Since(fi.ModTime()); age < ttl {
+			data, err := ioutil.ReadFile(cache)
+			if err == nil {
+				if servers, err = parseInventory(formatJSON, data); err == nil {
+					return servers, fmt.Sprintf("inventory cmd (cached %s ago)", age.Truncate(time.Second)), nil
+				}
+			}
+		}
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", inv.Cmd)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, "", fmt.Errorf("%s: %s", inv.Cmd, err)
+	}
+	if servers, err = parseInventory(formatJSON, stdout.Bytes()); err != nil {
+		return nil, "", fmt.Errorf("failed to parse output of %s: %s", inv.Cmd, err)
+	}
+	if ttl > 0 {
+		if err := os.MkdirAll(filepath.Dir(cache), 0700); err == nil {
+			err = ioutil.WriteFile(cache, stdout.Bytes(), 0600)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to cache inventory: %s\n", err)
+		}
+	}
+	return servers, "inventory cmd", nil
+}
+
+// inventoryCachePath returns the cache file of outputs of cmd. It's not in
+// .harp, which is removed on deploys.
+func inventoryCachePath(cmd string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(cmd))
+	return filepath.Join(dir, "harp", "inventory", hex.EncodeToString(sum[:8])+".json")
+}
+
+// parseInventory parses servers in an inventory: a list of servers or an
+// object with a Servers list.
+func parseInventory(format string, data []byte) ([]*Server, error) {
+	val, err := decodeConfigValue(format, data)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := val.(map[string]interface{}); ok {
+		val = m["Servers"]
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, errors.New("a list of servers is expected")
+	}
+	if data, err = json.Marshal(list); err != nil {
+		return nil, err
+	}
+	var servers []*Server
+	err = json.Unmarshal(data, &servers)
+	return servers, err
+}
+
+// listServers prints servers of the specified server sets and servers, or
+// all of them, without connecting to them.
+func listServers(args []string) {
+	if len(args) != 1 || (args[0] != "ls" && args[0] != "list") {
+		exitf("usage: harp [-s $set] [-server $server] servers ls")
+	}
+	if len(option.serverSets) == 0 && len(option.servers) == 0 {
+		option.all = true
+	}
+	servers := selectServers()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SET\tID\tSERVER\tTAGS\tSOURCE")
+	for _, s := range servers {
+		source := s.source
+		switch {
+		case source != "":
+		case s.Set == "":
+			source = "-server"
+		default:
+			source = "config"
+		}
+		var tags []string
+		for k, v := range s.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Set, s.ID, s, strings.Join(tags, ","), source)
+	}
+	w.Flush()
+}
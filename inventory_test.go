@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCache := os.Getenv("XDG_CACHE_HOME")
+	os.Setenv("XDG_CACHE_HOME", dir)
+	defer os.Setenv("XDG_CACHE_HOME", oldCache)
+
+	file := filepath.Join(dir, "hosts.yaml")
+	if err := ioutil.WriteFile(file, []byte("Servers:\n- ID: db-1\n  Host: 10.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	counter := filepath.Join(dir, "counter")
+	cmd := `echo run >> ` + counter + `; echo '[{"ID": "web-1", "Host": "10.0.1.1"}, {"ID": "web-2", "Host": "10.0.1.2", "User": "root"}]'`
+
+	oldCfg, oldOption, oldLoaded := cfg, option, inventoryLoaded
+	defer func() { cfg, option, inventoryLoaded = oldCfg, oldOption, oldLoaded }()
+	for i := 0; i < 2; i++ {
+		inventoryLoaded = map[string]bool{}
+		cfg = Config{
+			Servers: map[string][]*Server{"web": {{ID: "web-0", Host: "10.0.1.0"}}},
+			ServerSets: map[string]*ServerSet{
+				"web": {Inventory: &Inventory{Cmd: cmd, TTL: "1h"}, Defaults: &Server{User: "app"}},
+				"db":  {Inventory: &Inventory{File: file}},
+			},
+		}
+		cfg.setUpServer(cfg.Servers["web"][0], "web")
+		option.all, option.serverSets, option.servers = false, FlagStrings{"web"}, FlagStrings{"db-1"}
+		servers := selectServers()
+
+		var got []string
+		for _, s := range servers {
+			got = append(got, s.Set+" "+s.ID+" "+s.String())
+		}
+		want := []string{"web web-0 app@10.0.1.0", "web web-1 app@10.0.1.1", "web web-2 root@10.0.1.2", "db db-1 @10.0.2.1"}
+		if len(got) != len(want) {
+			t.Fatalf("servers = %q; want %q", got, want)
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("servers[%d] = %q; want %q", j, got[j], want[j])
+			}
+		}
+	}
+
+	if data, _ := ioutil.ReadFile(counter); string(data) != "run\n" {
+		t.Errorf("inventory cmd runs: %q; want once", data)
+	}
+	if names := serverSetNames(); len(names) != 2 || names[0] != "db" || names[1] != "web" {
+		t.Errorf("serverSetNames = %q", names)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/DisposaBoy/JsonConfigReader"
+)
+
+// jsonSpan is the byte range of a value in a config file.
+type jsonSpan struct{ start, end int }
+
+// cleanJSON strips comments and trailing commas of commented JSON. Stripped
+// bytes are replaced by spaces, so offsets are the same as the original.
+func cleanJSON(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(JsonConfigReader.New(bytes.NewReader(data)))
+}
+
+// findJSONValue returns the span of the value at path (object keys, or
+// indexes of arrays) in cleaned JSON data.
+func findJSONValue(data []byte, path ...string) (span jsonSpan, found bool, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	return scanJSONValue(dec, data, path)
+}
+
+func scanJSONValue(dec *json.Decoder, data []byte, path []string) (span jsonSpan, found bool, err error) {
+	span.start = skipJSONSpaces(data, int(dec.InputOffset()))
+	tok, err := dec.Token()
+	if err != nil {
+		return
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			var key json.Token
+			if key, err = dec.Token(); err != nil {
+				return
+			}
+			if len(path) > 0 && key == path[0] {
+				return scanJSONValue(dec, data, path[1:])
+			}
+			if _, _, err = scanJSONValue(dec, data, nil); err != nil {
+				return
+			}
+		}
+		if _, err = dec.Token(); err != nil {
+			return
+		}
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if len(path) > 0 && path[0] == strconv.Itoa(i) {
+				return scanJSONValue(dec, data, path[1:])
+			}
+			if _, _, err = scanJSONValue(dec, data, nil); err != nil {
+				return
+			}
+		}
+		if _, err = dec.Token(); err != nil {
+			return
+		}
+	}
+	span.end = int(dec.InputOffset())
+	return span, len(path) == 0, nil
+}
+
+func skipJSONSpaces(data []byte, i int) int {
+	for i < len(data) && bytes.IndexByte([]byte(" \t\r\n:,"), data[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+// lineIndent returns leading white spaces of the line at offset.
+func lineIndent(data []byte, offset int) string {
+	start := bytes.LastIndexByte(data[:offset], '\n') + 1
+	end := start
+	for end < len(data) && (data[end] == ' ' || data[end] == '\t') {
+		end++
+	}
+	return string(data[start:end])
+}
+
+// lineCol returns 1-based line and column numbers of offset.
+func lineCol(data []byte, offset int) (line, col int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	line = bytes.Count(data[:offset], []byte("\n")) + 1
+	col = offset - bytes.LastIndexByte(data[:offset], '\n')
+	return
+}
+
+// setJSONObjectField sets key of the object at path to the raw JSON value,
+// keeping the rest of the file (comments included) untouched. Missing
+// objects on path are created.
+func setJSONObjectField(data []byte, path []string, key string, value []byte) ([]byte, error) {
+	clean, err := cleanJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	full := append(append([]string{}, path...), key)
+	if span, found, err := findJSONValue(clean, full...); err != nil {
+		return nil, err
+	} else if found {
+		return splice(data, span, value), nil
+	}
+
+	// create the field (and its parent objects) in the closest object
+	parent := path
+	var span jsonSpan
+	for {
+		var found bool
+		if span, found, err = findJSONValue(clean, parent...); err != nil {
+			return nil, err
+		} else if found {
+			break
+		}
+		parent = parent[:len(parent)-1]
+	}
+	if clean[span.start] != '{' {
+		return nil, fmt.Errorf("%s is not an object", strings.Join(parent, "."))
+	}
+
+	// follow indentation of the existing fields
+	indent := lineIndent(data, span.start)
+	unit := "\t"
+	inner := skipJSONSpaces(clean, span.start+1)
+	empty := inner >= span.end-1
+	if !empty && bytes.IndexByte(data[span.start:inner], '\n') >= 0 {
+		if fieldIndent := lineIndent(data, inner); strings.HasPrefix(fieldIndent, indent) && len(fieldIndent) > len(indent) {
+			unit = fieldIndent[len(indent):]
+		}
+	}
+
+	missing := full[len(parent):]
+	for i := len(missing) - 1; i > 0; i-- {
+		value = []byte(fmt.Sprintf(
+			"{\n%s%q: %s\n%s}",
+			indent+strings.Repeat(unit, i+1), missing[i], value, indent+strings.Repeat(unit, i),
+		))
+	}
+	field := fmt.Sprintf("\n%s%s%q: %s", indent, unit, missing[0], value)
+
+	if empty {
+		return splice(data, span, []byte("{"+field+"\n"+indent+"}")), nil
+	}
+	// append after the last field
+	last := span.end - 1
+	for last > span.start && bytes.IndexByte([]byte(" \t\r\n"), clean[last-1]) >= 0 {
+		last--
+	}
+	return splice(data, jsonSpan{last, last}, []byte(","+field)), nil
+}
+
+func splice(data []byte, span jsonSpan, value []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(data[:span.start])
+	buf.Write(value)
+	buf.Write(data[span.end:])
+	return buf.Bytes()
+}
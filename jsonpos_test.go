@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestSetJSONObjectField(t *testing.T) {
+	for _, c := range []struct {
+		data, want string
+		path       []string
+		key, value string
+	}{
+		{
+			data: "{\n\t// comment\n\t\"Secrets\": {\n\t\t\"a\": \"1\", // trailing comma\n\t},\n}\n",
+			path: []string{"Secrets"}, key: "a", value: `"2"`,
+			want: "{\n\t// comment\n\t\"Secrets\": {\n\t\t\"a\": \"2\", // trailing comma\n\t},\n}\n",
+		},
+		{
+			data: "{\n\t\"Secrets\": {\n\t\t\"a\": \"1\" // comment\n\t}\n}\n",
+			path: []string{"Secrets"}, key: "b", value: `"2"`,
+			want: "{\n\t\"Secrets\": {\n\t\t\"a\": \"1\",\n\t\t\"b\": \"2\" // comment\n\t}\n}\n",
+		},
+		{
+			data: "{\n  \"App\": {\"Name\": \"app\"}\n}\n",
+			path: []string{"Secrets"}, key: "a", value: `"1"`,
+			want: "{\n  \"App\": {\"Name\": \"app\"},\n  \"Secrets\": {\n    \"a\": \"1\"\n  }\n}\n",
+		},
+		{
+			data: "{\"Secrets\": {}}",
+			path: []string{"Secrets"}, key: "a", value: `"1"`,
+			want: "{\"Secrets\": {\n\t\"a\": \"1\"\n}}",
+		},
+	} {
+		got, err := setJSONObjectField([]byte(c.data), c.path, c.key, []byte(c.value))
+		if err != nil {
+			t.Errorf("%q: %s", c.data, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+		}
+	}
+
+	data := []byte("{\n\t\"App\": {\n\t\t\"Name\": \"app\"\n\t}\n}")
+	span, found, err := findJSONValue(data, "App", "Name")
+	if err != nil || !found || string(data[span.start:span.end]) != `"app"` {
+		t.Errorf("findJSONValue = %v %t %v", span, found, err)
+	}
+	if line, col := lineCol(data, span.start); line != 3 || col != 11 {
+		t.Errorf("lineCol = %d:%d; want 3:11", line, col)
+	}
+}
@@ -2,102 +2,451 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"sync"
+	"text/template"
 	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
 )
 
-// TODO: put logs from different servers into a buffer and print one at at time
-func tailLog(servers []*Server, beginLineNum int) {
-	output := make(chan output)
-	go outputLogs(output)
-	for _, serv := range servers {
-		go func(serv *Server) {
-			serv.initPathes()
-			session := serv.getSession()
+// logOptions are flags of harp log.
+type logOptions struct {
+	follow  bool
+	lines   int    // number of lines printed before following, -1 for all
+	grep    string // extended regexp of lines to print
+	grepv   string // extended regexp of lines to omit
+	since   string // see parseLogTimeBound
+	until   string
+	rotated bool // read rotated logs too
 
-			logger := NewLogger(output, fmt.Sprintf("========================\n%s", serv))
-			session.Stdout = logger
-			session.Stderr = logger
+	merge       bool // order lines of all servers by timestamps
+	mergeWindow time.Duration
+	noColor     bool
+}
 
-			if err := session.Start(fmt.Sprintf("tail -f -n %d %s", beginLineNum, serv.LogPath())); err != nil {
-				exitf("tail -f harp/%s/app.log error: %s", cfg.App, err)
-			}
+const logUsage = "usage: harp [-s $set] log [-no-follow] [-n $lines] [-grep $regexp] [-v $regexp] [-since $time] [-until $time] [-rotated] [-merge] [-no-color]\n" +
+	"       harp [-s $set] log fetch -o $dir [-since $time] [-until $time]"
 
-			// TODO: close session before quitting program
-		}(serv)
+func parseLogFlags(args []string) logOptions {
+	var opts logOptions
+	var noFollow bool
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println(logUsage)
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&noFollow, "no-follow", false, "print logs and exit, instead of following them")
+	fs.IntVar(&opts.lines, "n", option.tailBeginLineNum, "number of last lines printed (all lines with -since or -until, unless specified)")
+	fs.StringVar(&opts.grep, "grep", "", "only print lines matching the extended regexp (grep -E on servers)")
+	fs.StringVar(&opts.grepv, "v", "", "omit lines matching the extended regexp (grep -v -E on servers)")
+	fs.StringVar(&opts.since, "since", "", "only print lines logged since the time, a duration (e.g. 1h, 30m) or time (e.g. 2016-11-18T10:00), by timestamps at the beginning of lines")
+	fs.StringVar(&opts.until, "until", "", "only print lines logged until the time, same format as -since")
+	fs.BoolVar(&opts.rotated, "rotated", false, "read rotated logs (e.g. app.log.1, app.log.2.gz) before app.log, implied by -since and -until")
+	fs.BoolVar(&opts.merge, "merge", false, "merge lines of all servers, ordered by timestamps at the beginning of lines")
+	fs.DurationVar(&opts.mergeWindow, "merge-window", 2*time.Second, "how long lines are held for ordering when following with -merge")
+	fs.BoolVar(&opts.noColor, "no-color", false, "no colors in server prefixes (default for non-terminal outputs and $NO_COLOR)")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		exitf(logUsage)
+	}
+	for _, bound := range []string{opts.since, opts.until} {
+		if _, err := parseLogTimeBound(bound); err != nil {
+			exitf("%s", err)
+		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	wg.Wait()
+	opts.follow = !noFollow
+	if opts.since != "" || opts.until != "" {
+		explicit := false
+		fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "n" })
+		if !explicit {
+			opts.lines = -1
+		}
+	}
+	return opts
 }
 
-type Logger struct {
-	// data []byte
-	prefix []byte
-	mutex  sync.Mutex
-	Buffer bytes.Buffer
+var logTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+	"2006/01/02",
+}
 
-	output chan output
+// parseLogTimeBound parses -since and -until: durations ago on servers
+// (e.g. 1h), or time in logs (e.g. 2016-11-18T10:00). It returns a shell
+// word of the time in digits (e.g. 20161118100000), which are compared with
+// timestamps in logs.
+func parseLogTimeBound(str string) (string, error) {
+	if str == "" {
+		return "", nil
+	}
+	if d, err := time.ParseDuration(str); err == nil {
+		return fmt.Sprintf(`"$(t=$(( $(date +%%s) - %d )); date -d @$t +%%Y%%m%%d%%H%%M%%S 2>/dev/null || date -r $t +%%Y%%m%%d%%H%%M%%S)"`, int64(d/time.Second)), nil
+	}
+	for _, layout := range logTimeLayouts {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t.Format("20060102150405"), nil
+		}
+	}
+	return "", fmt.Errorf("bad time %q: a duration (e.g. 1h) or time (e.g. 2016-11-18T10:00) is expected", str)
 }
 
-type output struct {
-	data   []byte
-	prefix []byte
+// logTmpls are scripts reading logs on servers. timeFilter filters lines by
+// timestamps in [$since, $until], lines without timestamps (e.g. stack
+// traces) go with the previous line.
+var logTmpls = template.Must(template.New("").Parse(`{{define "timeFilter" -}}
+	awk -v since="$since" -v until="$until" '{
+		if (match($0, /^\[?[0-9][0-9][0-9][0-9][-\/][0-9][0-9][-\/][0-9][0-9][ T][0-9][0-9]:[0-9][0-9]:[0-9][0-9]/)) {
+			ts = substr($0, RSTART, RLENGTH); gsub(/[^0-9]/, "", ts); show = ts >= since && (until == "" || ts <= until)
+		}
+		if (show) { print; fflush() }
+	}'
+{{- end}}
+
+{{- /* skipOlder skips rotated log $f modified before $since */ -}}
+{{define "skipOlder"}}
+{{- if .Since}}
+		if [[ $(date -r $f +%Y%m%d%H%M%S 2>/dev/null || stat -f %Sm -t %Y%m%d%H%M%S $f) < $since ]]; then
+			continue
+		fi
+{{- end}}
+{{- end}}
+
+{{- /*
+log prints logs of the app: rotated logs (oldest first, with compressed
+ones decompressed, only the ones possibly in the time range if any), app.log
+and new lines appended to it if following, through the filters. Following
+runs in background, until stdin is closed by harp, which kills the process
+group, so that nothing is left running on the server when harp quits.
+*/ -}}
+{{define "log" -}}
+log={{.Log}}
+{{- if .TimeRange}}
+since={{.Since}}
+until={{.Until}}
+{{- end}}
+filter() {
+	{{- if .TimeRange}}
+	{{template "timeFilter"}} |
+	{{- end}}
+	{{- if .Grep}}
+	grep --line-buffered -E -e {{.Grep}} |
+	{{- end}}
+	{{- if .GrepV}}
+	grep --line-buffered -v -E -e {{.GrepV}} |
+	{{- end}}
+	cat
 }
+n=$(( $(wc -l 2>/dev/null < $log) + 0 ))
+{
+	{{- if or .Rotated .TimeRange}}
+	for f in $(ls -1tr $log.* $log-* 2>/dev/null); do
+		{{- template "skipOlder" .}}
+		case $f in
+		*.gz) gzip -dc $f ;;
+		*.bz2) bzip2 -dc $f ;;
+		*.xz) xz -dc $f ;;
+		*) cat $f ;;
+		esac
+	done
+	{{- end}}
+	head -n $n $log 2>/dev/null
+} | filter{{if ge .Lines 0}} | tail -n {{.Lines}}{{end}}
+{{- if .Follow}}
+tail -n +$((n + 1)) -F $log 2>/dev/null | filter &
+cat > /dev/null
+kill 0
+{{- end}}
+{{end}}`))
 
-func NewLogger(outputc chan output, prefix string) (l *Logger) {
-	l = &Logger{}
-	l.output = outputc
-	l.prefix = []byte(prefix)
-	ticker := time.NewTicker(time.Second * 3)
+// logScript returns the script printing logs of the app on the server.
+func (s *Server) logScript(opts logOptions) string {
+	var buf bytes.Buffer
+	data := struct {
+		Log          string
+		TimeRange    bool
+		Since, Until string
+		Grep, GrepV  string
+		Rotated      bool
+		Lines        int
+		Follow       bool
+	}{
+		Log:       s.LogPath(),
+		TimeRange: opts.since != "" || opts.until != "",
+		Rotated:   opts.rotated,
+		Lines:     opts.lines,
+		Follow:    opts.follow,
+	}
+	data.Since, _ = parseLogTimeBound(opts.since)
+	data.Until, _ = parseLogTimeBound(opts.until)
+	if opts.grep != "" {
+		data.Grep = shellQuote(opts.grep)
+	}
+	if opts.grepv != "" {
+		data.GrepV = shellQuote(opts.grepv)
+	}
+	if err := logTmpls.ExecuteTemplate(&buf, "log", data); err != nil {
+		s.exitf("failed to execute log script template: %s", err)
+	}
+	return buf.String()
+}
+
+// tailLog prints logs of servers line by line, until all of them are
+// printed, or Ctrl-C when following, which closes all the sessions.
+func tailLog(servers []*Server, opts logOptions) {
+	color := !opts.noColor && os.Getenv("NO_COLOR") == "" && terminal.IsTerminal(int(os.Stdout.Fd()))
+	printer := newLogPrinter(os.Stdout, servers, color)
+	printer.merge = opts.merge
+	if opts.follow {
+		printer.window = opts.mergeWindow
+	}
+	lines := make(chan logLine, 1024)
+	printed := make(chan struct{})
 	go func() {
-		for {
-			<-ticker.C
-			l.mutex.Lock()
-			data := l.Buffer.Bytes()
-			l.Buffer.Reset()
-			l.mutex.Unlock()
-			go func() {
-				if len(data) == 0 {
-					return
-				}
-				l.output <- output{data, l.prefix}
-			}()
-		}
+		printer.run(lines)
+		close(printed)
 	}()
 
-	return l
+	var (
+		mutex   sync.Mutex
+		stopped bool
+		stops   []func()
+	)
+	defer onInterrupt(func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		stopped = true
+		for _, stop := range stops {
+			stop()
+		}
+	})()
+
+	l := newLimiter(len(servers))
+	var wg sync.WaitGroup
+	for i, serv := range servers {
+		wg.Add(1)
+		l.acquire()
+		go func(i int, serv *Server) {
+			defer wg.Done()
+			released := false
+			release := func() {
+				if !released {
+					released = true
+					l.release()
+				}
+			}
+			defer release()
+
+			serv.initPathes()
+			session := serv.newSession(0)
+			stdin, err := session.StdinPipe()
+			if err != nil {
+				serv.exitf("failed to open stdin of %s: %s", serv, err)
+			}
+			w := &lineWriter{server: i, lines: lines}
+			defer w.Close()
+			session.Stdout = w
+			session.Stderr = w
+
+			mutex.Lock()
+			if stopped {
+				mutex.Unlock()
+				session.Close()
+				return
+			}
+			stops = append(stops, func() {
+				// closing stdin kills the logging processes
+				stdin.Close()
+				session.Close()
+			})
+			mutex.Unlock()
+
+			if err := session.Start(serv.logScript(opts)); err != nil {
+				serv.exitf("failed to read %s on %s: %s", serv.LogPath(), serv, err)
+			}
+			if opts.follow {
+				// following never ends, the limit only applies to starting
+				// sessions
+				release()
+			}
+			session.Wait()
+		}(i, serv)
+	}
+	wg.Wait()
+	close(lines)
+	<-printed
+}
+
+// logLine is a line of logs from a server.
+type logLine struct {
+	server  int // index of the server
+	text    string
+	time    time.Time // timestamp of the line, or the previous one
+	arrival time.Time
 }
 
-func (l *Logger) Write(data []byte) (n int, err error) {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+var logTimeRegexp = regexp.MustCompile(`^\[?(\d{4})[-/](\d{2})[-/](\d{2})[ T](\d{2}):(\d{2}):(\d{2})(\.\d+)?`)
 
-	n, err = l.Buffer.Write(data)
-	if l.Buffer.Len() < 1024 {
-		return
+// parseLogTime parses timestamp at the beginning of the line, in formats
+// like 2006/01/02 15:04:05 (the log package) and 2006-01-02T15:04:05.000
+// (RFC 3339). Time zones are ignored, like in -since.
+func parseLogTime(line string) (time.Time, bool) {
+	m := logTimeRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return time.Time{}, false
 	}
+	var n [6]int
+	for i := range n {
+		n[i], _ = strconv.Atoi(m[i+1])
+	}
+	var nsec int
+	if m[7] != "" {
+		frac := (m[7][1:] + "000000000")[:9]
+		nsec, _ = strconv.Atoi(frac)
+	}
+	return time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], nsec, time.UTC), true
+}
 
-	data = l.Buffer.Bytes()
-	l.Buffer.Reset()
-	go func() {
-		l.output <- output{data, l.prefix}
-	}()
+// lineWriter splits outputs of a server into lines.
+type lineWriter struct {
+	server int
+	lines  chan<- logLine
 
-	return
+	mutex sync.Mutex // stdout and stderr are written concurrently
+	buf   []byte
+	last  time.Time
 }
 
-func outputLogs(outputc chan output) {
-	var old output
+func (w *lineWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, data...)
 	for {
-		output := <-outputc
-		if !bytes.Equal(output.prefix, old.prefix) {
-			log.Print(string(output.prefix))
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.send(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+func (w *lineWriter) send(text string) {
+	if t, ok := parseLogTime(text); ok {
+		w.last = t
+	}
+	w.lines <- logLine{server: w.server, text: text, time: w.last, arrival: time.Now()}
+}
+
+// Close sends the last line without a line break.
+func (w *lineWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.buf) > 0 {
+		w.send(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
+
+// logColors are ANSI colors of server prefixes.
+var logColors = []int{36, 33, 32, 35, 34, 31, 96, 93, 92, 95, 94, 91}
+
+// logPrinter prints lines of servers, prefixed by server IDs (or
+// User@Host:Port) in colors. With merge, lines are held for window and
+// printed in the order of their timestamps, window 0 holds all the lines
+// until the end.
+type logPrinter struct {
+	out      io.Writer
+	prefixes []string
+	merge    bool
+	window   time.Duration
+}
+
+func newLogPrinter(out io.Writer, servers []*Server, color bool) *logPrinter {
+	p := &logPrinter{out: out}
+	var width int
+	names := make([]string, len(servers))
+	for i, s := range servers {
+		names[i] = firstNonEmpty(s.ID, s.String())
+		if len(names[i]) > width {
+			width = len(names[i])
 		}
-		log.Print(string(output.data))
-		old = output
 	}
+	for i, name := range names {
+		prefix := fmt.Sprintf("%-*s |", width, name)
+		if color {
+			prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", logColors[i%len(logColors)], prefix)
+		}
+		p.prefixes = append(p.prefixes, prefix)
+	}
+	return p
+}
+
+func (p *logPrinter) print(line logLine) {
+	fmt.Fprintf(p.out, "%s %s\n", p.prefixes[line.server], line.text)
+}
+
+// run prints lines until the channel is closed.
+func (p *logPrinter) run(lines <-chan logLine) {
+	if !p.merge {
+		for line := range lines {
+			p.print(line)
+		}
+		return
+	}
+
+	var held []logLine
+	flush := func(before time.Time) {
+		n := len(held)
+		if !before.IsZero() {
+			n = sort.Search(len(held), func(i int) bool { return held[i].arrival.After(before) })
+		}
+		batch := held[:n]
+		sort.SliceStable(batch, func(i, j int) bool { return batch[i].time.Before(batch[j].time) })
+		for _, line := range batch {
+			p.print(line)
+		}
+		held = append([]logLine{}, held[n:]...)
+	}
+	var tick <-chan time.Time
+	if p.window > 0 {
+		ticker := time.NewTicker(p.window / 4)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush(time.Time{})
+				return
+			}
+			held = append(held, line)
+		case now := <-tick:
+			flush(now.Add(-p.window))
+		}
+	}
+}
+
+// logCmd handles harp log.
+func logCmd(servers []*Server, args []string) {
+	if len(args) > 0 && args[0] == "fetch" {
+		fetchLogs(servers, args[1:])
+		return
+	}
+	tailLog(servers, parseLogFlags(args))
 }
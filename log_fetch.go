@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+// logFetchTmpl archives app.log, history.log and rotated logs in tar.gz to
+// stdout. With a time range, logs are decompressed and filtered on the
+// server first (rotated logs modified before the range are skipped),
+// history.log is always kept as it is.
+var logFetchTmpl = template.Must(logTmpls.New("fetch").Parse(`cd {{.LogDir}} 2>/dev/null || exit 0
+files=$(ls -1 app.log history.log app.log.* app.log-* 2>/dev/null)
+{{- if .TimeRange}}
+since={{.Since}}
+until={{.Until}}
+tmp=$(mktemp -d)
+trap 'rm -rf $tmp' EXIT
+for f in $files; do
+	if [ $f = history.log ]; then
+		cp $f $tmp/
+		continue
+	fi
+	{{- template "skipOlder" .}}
+	name=${f%.gz}
+	name=${name%.bz2}
+	name=${name%.xz}
+	case $f in
+	*.gz) gzip -dc $f ;;
+	*.bz2) bzip2 -dc $f ;;
+	*.xz) xz -dc $f ;;
+	*) cat $f ;;
+	esac | {{template "timeFilter"}} > $tmp/$name
+	[ -s $tmp/$name ] || rm -f $tmp/$name
+done
+cd $tmp
+files=$(ls -1)
+{{- end}}
+if [ -n "$files" ]; then
+	tar czf - $files
+fi
+`))
+
+// fetchedLog is a log file downloaded from a server.
+type fetchedLog struct {
+	name string
+	size int64
+}
+
+// countingReader counts bytes read, i.e. bytes transferred.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fetchLogs handles harp log fetch: downloading logs of servers into
+// dir/<set>/<server>/.
+func fetchLogs(servers []*Server, args []string) {
+	var dir, since, until string
+	fs := flag.NewFlagSet("log fetch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println(logUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&dir, "o", "", "directory saving logs, as $dir/$set/$server/")
+	fs.StringVar(&since, "since", "", "only fetch lines logged since the time, a duration (e.g. 1h) or time (e.g. 2016-11-18T10:00)")
+	fs.StringVar(&until, "until", "", "only fetch lines logged until the time, same format as -since")
+	fs.Parse(args)
+	if dir == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	sinceWord, err := parseLogTimeBound(since)
+	if err != nil {
+		exitf("%s", err)
+	}
+	untilWord, err := parseLogTimeBound(until)
+	if err != nil {
+		exitf("%s", err)
+	}
+
+	type result struct {
+		dir         string
+		files       []fetchedLog
+		transferred int64
+		err         error
+	}
+	results := make([]result, len(servers))
+	eachServer(servers, func(i int, s *Server) {
+		r := &results[i]
+		r.dir = filepath.Join(dir, s.logFetchDir())
+		var script bytes.Buffer
+		err := logFetchTmpl.Execute(&script, map[string]interface{}{
+			"LogDir":    s.GetLogDir(),
+			"TimeRange": since != "" || until != "",
+			"Since":     sinceWord,
+			"Until":     untilWord,
+		})
+		if err != nil {
+			s.exitf("failed to execute logFetchTmpl: %s", err)
+		}
+		r.files, r.transferred, r.err = s.fetchLogs(script.String(), r.dir)
+	})
+
+	var failed bool
+	var total, transferred int64
+	var count int
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SET\tSERVER\tFILE\tSIZE")
+	for i, r := range results {
+		s := servers[i]
+		if r.err != nil {
+			failed = true
+			fmt.Fprintf(w, "%s\t%s\terror: %s\t\n", s.Set, s, r.err)
+			continue
+		}
+		if len(r.files) == 0 {
+			fmt.Fprintf(w, "%s\t%s\tno logs\t\n", s.Set, s)
+		}
+		for _, f := range r.files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Set, s, filepath.Join(r.dir, f.name), fmtFileSize(f.size))
+			total += f.size
+		}
+		count += len(r.files)
+		transferred += r.transferred
+	}
+	w.Flush()
+	fmt.Printf("fetched %d files (%s, %s transferred) into %s\n", count, fmtFileSize(total), fmtFileSize(transferred), dir)
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// logFetchDir returns the directory of fetched logs of the server:
+// <set>/<ID or User@Host_Port>.
+func (s *Server) logFetchDir() string {
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(firstNonEmpty(s.ID, s.String()))
+	return filepath.Join(firstNonEmpty(s.Set, "_"), name)
+}
+
+// fetchLogs runs the fetch script and extracts the archive into dir.
+func (s *Server) fetchLogs(script, dir string) (files []fetchedLog, transferred int64, err error) {
+	session, err := s.openSession(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Start(script); err != nil {
+		return nil, 0, err
+	}
+
+	counter := &countingReader{r: stdout}
+	if files, err = extractLogs(counter, dir); err != nil {
+		// unblocks the script writing the rest of the archive
+		session.Close()
+	}
+	if werr := session.Wait(); werr != nil && err == nil {
+		err = fmt.Errorf("%s: %s", werr, strings.TrimSpace(stderr.String()))
+	}
+	return files, counter.n, err
+}
+
+// extractLogs extracts logs in tar.gz into dir, empty input means no logs.
+func extractLogs(r io.Reader, dir string) ([]fetchedLog, error) {
+	gz, err := gzip.NewReader(r)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var files []fetchedLog
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return files, err
+		}
+		name := filepath.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || name != hdr.Name {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return files, err
+		}
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return files, err
+		}
+		n, err := io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(files, fetchedLog{name: name, size: n})
+	}
+	return files, nil
+}
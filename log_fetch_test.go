@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFetchLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-log-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logDir := filepath.Join(dir, "log")
+	os.Mkdir(logDir, 0755)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("2016/11/17 10:00:00 old\n"))
+	w.Close()
+	ioutil.WriteFile(filepath.Join(logDir, "app.log.1.gz"), gz.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(logDir, "app.log"), []byte("2016/11/18 09:00:00 a\n2016/11/18 10:00:00 b\n\tstack\n2016/11/18 11:00:00 c\n"), 0644)
+	ioutil.WriteFile(filepath.Join(logDir, "history.log"), []byte("[harp] deploy\n"), 0644)
+	ioutil.WriteFile(filepath.Join(logDir, "other.txt"), []byte("other\n"), 0644)
+
+	fetch := func(since, until string) map[string]string {
+		sinceWord, _ := parseLogTimeBound(since)
+		untilWord, _ := parseLogTimeBound(until)
+		var script bytes.Buffer
+		err := logFetchTmpl.Execute(&script, map[string]interface{}{
+			"LogDir":    logDir,
+			"TimeRange": since != "" || until != "",
+			"Since":     sinceWord,
+			"Until":     untilWord,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("bash", "-c", script.String()).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(dir, "fetched", since+until)
+		if _, err := extractLogs(bytes.NewReader(out), dst); err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		infos, _ := ioutil.ReadDir(dst)
+		for _, info := range infos {
+			data, _ := ioutil.ReadFile(filepath.Join(dst, info.Name()))
+			got[info.Name()] = string(data)
+		}
+		return got
+	}
+
+	got := fetch("", "")
+	if len(got) != 3 || got["history.log"] != "[harp] deploy\n" || got["app.log.1.gz"] != gz.String() {
+		t.Errorf("fetched logs: %q", got)
+	}
+	got = fetch("2016-11-18T10:00", "2016/11/18 10:30")
+	want := map[string]string{"app.log": "2016/11/18 10:00:00 b\n\tstack\n", "history.log": "[harp] deploy\n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fetched logs in time range = %q; want %q", got, want)
+	}
+
+	if files, err := extractLogs(bytes.NewReader(nil), dir); files != nil || err != nil {
+		t.Errorf("extractLogs(empty) = %v, %v", files, err)
+	}
+}
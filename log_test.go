@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLogScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Server{LogDir: dir}
+
+	old := time.Now().Add(-2 * time.Hour).Format("2006/01/02 15:04:05")
+	now := time.Now().Format("2006/01/02 15:04:05")
+	gz, err := os.Create(s.LogPath() + ".2.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(gz)
+	w.Write([]byte(old + " rotated 2\n"))
+	w.Close()
+	gz.Close()
+	os.Chtimes(gz.Name(), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	ioutil.WriteFile(s.LogPath()+".1", []byte(old+" rotated 1\n"), 0644)
+	ioutil.WriteFile(s.LogPath(), []byte(old+" error 1\n"+now+" error 2\n\tstack\n"+now+" info\n"), 0644)
+
+	run := func(opts logOptions) string {
+		out, err := exec.Command("bash", "-c", s.logScript(opts)).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %s", err, out)
+		}
+		return string(out)
+	}
+	for _, c := range []struct {
+		opts logOptions
+		want []string
+	}{
+		{logOptions{lines: 2}, []string{"stack", "info"}},
+		{logOptions{lines: -1, rotated: true, grep: "rotated"}, []string{"rotated 2", "rotated 1"}},
+		{logOptions{lines: -1, since: "1h"}, []string{"error 2", "stack", "info"}},
+		{logOptions{lines: -1, since: "1h", grepv: "info|stack"}, []string{"error 2"}},
+	} {
+		lines := strings.Split(strings.TrimSpace(run(c.opts)), "\n")
+		if len(lines) != len(c.want) {
+			t.Errorf("%+v: got %q; want %q", c.opts, lines, c.want)
+			continue
+		}
+		for i, line := range lines {
+			if !strings.HasSuffix(line, c.want[i]) {
+				t.Errorf("%+v: line %d = %q; want %q", c.opts, i, line, c.want[i])
+			}
+		}
+	}
+
+	// following stops when stdin is closed
+	cmd := exec.Command("bash", "-c", s.logScript(logOptions{follow: true, lines: 1, grep: "error"}))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(stdout)
+	if line, _ := r.ReadString('\n'); !strings.HasSuffix(line, "error 2\n") {
+		t.Errorf("first line = %q", line)
+	}
+	f, _ := os.OpenFile(s.LogPath(), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(now + " info\n" + now + " error 3\n")
+	f.Close()
+	if line, _ := r.ReadString('\n'); !strings.HasSuffix(line, "error 3\n") {
+		t.Errorf("followed line = %q", line)
+	}
+	stdin.Close()
+	done := make(chan error)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		t.Error("following doesn't stop after stdin is closed")
+	}
+}
+
+func TestLogPrinter(t *testing.T) {
+	if got, ok := parseLogTime("2016-11-18T10:03:12.5Z msg"); !ok || !got.Equal(time.Date(2016, 11, 18, 10, 3, 12, 5e8, time.UTC)) {
+		t.Errorf("parseLogTime = %s, %t", got, ok)
+	}
+	if _, ok := parseLogTime("\tat main.go:12"); ok {
+		t.Error("parseLogTime accepts lines without timestamps")
+	}
+
+	servers := []*Server{{ID: "web-1"}, {User: "app", Host: "h2"}}
+	var buf bytes.Buffer
+	p := newLogPrinter(&buf, servers, false)
+	p.merge = true
+	lines := make(chan logLine, 16)
+	w1 := &lineWriter{server: 0, lines: lines}
+	w2 := &lineWriter{server: 1, lines: lines}
+	w1.Write([]byte("2016/11/18 10:00:01 a\n\tstack"))
+	w2.Write([]byte("2016/11/18 10:00:00 b\n2016/11/18 10:00:02 c\n"))
+	w1.Close()
+	close(lines)
+	p.run(lines)
+
+	want := "app@h2 | 2016/11/18 10:00:00 b\n" +
+		"web-1  | 2016/11/18 10:00:01 a\n" +
+		"web-1  | \tstack\n" +
+		"app@h2 | 2016/11/18 10:00:02 c\n"
+	if buf.String() != want {
+		t.Errorf("merged logs:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LogRotate configures rotation of app.log. Outputs of the app are piped
+// through a small writer (an awk script in the restart script), which
+// rotates app.log once it exceeds MaxSize, as app.log.1, app.log.2, etc.
+// It's also rotated at restart if it's already too large.
+type LogRotate struct {
+	// MaxSize is the approximate max size of app.log, e.g. 100MB, 512KB,
+	// 1G or bytes. Default: 100MB.
+	MaxSize string
+	// Keep is the number of rotated logs kept. Default: 5.
+	Keep int
+	// Compress rotated logs by gzip (app.log.1.gz).
+	Compress bool
+}
+
+const (
+	defaultLogMaxSize = 100 << 20
+	defaultLogKeep    = 5
+)
+
+// parseSize parses sizes like 100MB, 512K, 1GB and 2048 (bytes), units are
+// powers of 1024.
+func parseSize(str string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(str))
+	s = strings.TrimSuffix(s, "B")
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q: e.g. 100MB, 512KB or bytes is expected", str)
+	}
+	return n * unit, nil
+}
+
+// logWriterScript returns the command writing outputs of the app into
+// app.log, rotating it by LogRotate. It's awk, so it runs on any servers
+// without installing anything, and it's in the restart script, so that
+// rollback.sh restores it with the release.
+//
+// It reads outputs of the app from a fifo (see restartScript), and exits
+// after the app closes its outputs.
+func (s *Server) logWriterScript() string {
+	rotate := cfg.App.LogRotate
+	maxSize := int64(defaultLogMaxSize)
+	if rotate.MaxSize != "" {
+		var err error
+		if maxSize, err = parseSize(rotate.MaxSize); err != nil {
+			s.exitf("failed to parse LogRotate.MaxSize: %s", err)
+		}
+	}
+	keep := rotate.Keep
+	if keep <= 0 {
+		keep = defaultLogKeep
+	}
+	ext := ""
+	if rotate.Compress {
+		ext = ".gz"
+	}
+
+	// shift app.log.N to app.log.N+1, and the oldest one is removed
+	log := s.LogPath()
+	shift := fmt.Sprintf("rm -f %s.%d%s", log, keep, ext)
+	for i := keep - 1; i >= 1; i-- {
+		shift += fmt.Sprintf("; [ ! -f %[1]s.%[2]d%[3]s ] || mv -f %[1]s.%[2]d%[3]s %[1]s.%[4]d%[3]s", log, i, ext, i+1)
+	}
+	shift += fmt.Sprintf("; mv -f %[1]s %[1]s.1", log)
+	if rotate.Compress {
+		shift += fmt.Sprintf(" && gzip -f %s.1", log)
+	}
+
+	// mawk reads inputs in blocks unless -W interactive, which would hold
+	// lines of the app until the buffer is filled
+	return fmt.Sprintf(`awk $(awk -W version 2>&1 | grep -q mawk && echo -W interactive) -v file=%s -v max=%d -v shift=%s '
+function rotate() {
+	close(file)
+	system(shift)
+	size = 0
+}
+BEGIN {
+	cmd = "wc -c < " file " 2>/dev/null"
+	if ((cmd | getline size) <= 0) size = 0
+	close(cmd)
+	size += 0
+	if (size >= max) rotate()
+}
+{
+	if (size > 0 && size + length($0) + 1 > max) rotate()
+	print >> file
+	fflush(file)
+	size += length($0) + 1
+}'`, log, maxSize, shellQuote(shift))
+}
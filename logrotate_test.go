@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for str, want := range map[string]int64{"100MB": 100 << 20, "512k": 512 << 10, "1G": 1 << 30, "2048": 2048, "3 KB": 3 << 10} {
+		if got, err := parseSize(str); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", str, got, err, want)
+		}
+	}
+	for _, str := range []string{"", "MB", "-1MB", "1TB"} {
+		if _, err := parseSize(str); err == nil {
+			t.Errorf("parseSize(%q) succeeds", str)
+		}
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-logrotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	s := &Server{LogDir: dir}
+	write := func(lines int) {
+		script := fmt.Sprintf("for i in $(seq %d); do echo 0123456789012345678; done | %s", lines, s.logWriterScript())
+		if out, err := exec.Command("bash", "-c", script).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s", err, out)
+		}
+	}
+	files := func() (names []string) {
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		sort.Strings(names)
+		return
+	}
+
+	// 20 bytes per line, 1KB holds 51 lines
+	cfg.App.LogRotate = &LogRotate{MaxSize: "1KB", Keep: 2}
+	write(120)
+	if got, want := files(), []string{"app.log", "app.log.1", "app.log.2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("logs = %q; want %q", got, want)
+	}
+	for _, name := range []string{"app.log.2", "app.log.1"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Size() != 51*20 {
+			t.Errorf("%s: %v, %v", name, info, err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(s.LogPath()); len(data) != 18*20 {
+		t.Errorf("app.log has %d bytes; want %d", len(data), 18*20)
+	}
+
+	// rotated at start as app.log is too large, and older logs are removed
+	cfg.App.LogRotate = &LogRotate{MaxSize: "360", Keep: 2, Compress: true}
+	os.Remove(filepath.Join(dir, "app.log.2"))
+	os.Remove(filepath.Join(dir, "app.log.1"))
+	write(1)
+	if got, want := files(), []string{"app.log", "app.log.1.gz"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("logs = %q; want %q", got, want)
+	}
+	if data, _ := ioutil.ReadFile(s.LogPath()); len(data) != 20 {
+		t.Errorf("app.log has %d bytes; want 20", len(data))
+	}
+}
+
+func TestRestartWithLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.App.Name = "app"
+	cfg.App.KillSig = "TERM"
+	cfg.App.LogRotate = &LogRotate{MaxSize: "1MB"}
+	s := &Server{Home: dir, AppDir: filepath.Join(dir, "app")}
+	for _, d := range []string{filepath.Join(dir, "harp", "app"), filepath.Join(dir, "app", "bin")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the app keeps logging for a while after TERM
+	app := "#!/bin/sh\ntrap 'for i in 1 2 3 4 5 6; do echo bye; sleep 0.05; done; exit 0' TERM\nwhile true; do echo tick; sleep 0.05; done\n"
+	if err := ioutil.WriteFile(s.BinPath(), []byte(app), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shell exits right after starting the app, and its process group
+	// is hung up later like an ssh session being closed
+	restart := func() (pgid int) {
+		cmd := exec.Command("bash", "-c", s.restartScript("restart", "me", ""))
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s", err, out)
+		}
+		return cmd.Process.Pid
+	}
+	readPID := func(path string) int {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pid int
+		if _, err := fmt.Sscan(string(data), &pid); err != nil {
+			t.Fatal(err)
+		}
+		return pid
+	}
+	// zombies are not reaped by every init
+	alive := func(pid int) bool {
+		out, err := exec.Command("ps", "-o", "stat=", "-p", fmt.Sprint(pid)).Output()
+		return err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+	}
+	size := func() int64 {
+		info, err := os.Stat(s.LogPath())
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	waitLogging := func() {
+		started := size()
+		for deadline := time.Now().Add(5 * time.Second); size() == started; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("app.log isn't written by the app")
+			}
+		}
+	}
+
+	pgid := restart()
+	defer syscall.Kill(-pgid, syscall.SIGKILL)
+	pid := readPID(s.PIDPath())
+
+	// hangs up after the app starts logging, nohup ignores SIGHUP by then
+	waitLogging()
+	syscall.Kill(-pgid, syscall.SIGHUP)
+	time.Sleep(100 * time.Millisecond)
+	before := size()
+	time.Sleep(300 * time.Millisecond)
+	if !alive(pid) {
+		t.Fatal("app exited after the shell")
+	}
+	if after := size(); after <= before {
+		t.Errorf("app.log stops growing after the shell exits: %d -> %d bytes", before, after)
+	}
+
+	// restarting waits for the previous app and writer, so that there is
+	// only one writer of app.log
+	writer := readPID(s.LogWriterPIDPath())
+	pgid2 := restart()
+	defer syscall.Kill(-pgid2, syscall.SIGKILL)
+	if alive(pid) || alive(writer) {
+		t.Errorf("previous app (%t) or writer (%t) is still running", alive(pid), alive(writer))
+	}
+	waitLogging()
+	if !alive(readPID(s.PIDPath())) || !alive(readPID(s.LogWriterPIDPath())) {
+		t.Error("app or writer is not running after restart")
+	}
+	if log, _ := ioutil.ReadFile(s.LogPath()); strings.Count(string(log), "bye") != 6 {
+		t.Errorf("app.log has %d lines logged by the previous app at exit; want 6", strings.Count(string(log), "bye"))
+	}
+}
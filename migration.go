@@ -22,53 +22,60 @@ import (
 
 func migrate(servers []*Server, migrations []Migration) {
 	defer initTmpDir()()
-	cmd("mkdir", "-p", tmpDir+"/migrations")
 
 	if !option.noBuild {
 		println("building")
-		for _, migration := range migrations {
-			// cmd("go", "build", "-o", tmpDir+"/migrations/"+migration.Base, migration.File)
-			output := filepath.Join(tmpDir, "migrations", migration.Base)
-			build := fmt.Sprintf("go build -o %s %s", output, migration.File)
-
-			// Note: Build override doesn't support non-import-path migrations
-			if cfg.App.BuildCmd != "" {
-				build = fmt.Sprintf(cfg.App.BuildCmd, output, migration.File)
-			}
-
-			if option.debug {
-				println("build cmd:", build)
-			}
-			cmd("sh", "-c", build)
+		targets := retrieveBuildTargets(servers, true)
+		var wg sync.WaitGroup
+		for _, t := range targets {
+			wg.Add(1)
+			go func(t buildTarget) {
+				defer wg.Done()
+				buildMigrations(t, migrations)
+			}(t)
 		}
+		wg.Wait()
 
 		println("bundling")
-		bundleMigration(migrations)
+		for _, t := range targets {
+			bundleMigration(t, migrations)
+		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(servers))
-	for _, server := range servers {
-		go func(server *Server) {
-			if !option.noUpload {
-				println(server.String(), "uploading")
-				server.uploadMigration(migrations)
-			}
+	eachServer(servers, func(_ int, server *Server) {
+		if !option.noUpload {
+			println(server.String(), "uploading")
+			server.uploadMigration(migrations)
+		}
 
-			if !option.noDeploy {
-				println(server.String(), "running")
-				server.runMigration(migrations)
-			}
+		if !option.noDeploy {
+			println(server.String(), "running")
+			server.runMigration(migrations)
+		}
+	})
+	time.Sleep(time.Second * 2)
+}
+
+func buildMigrations(t buildTarget, migrations []Migration) {
+	cmd("mkdir", "-p", filepath.Join(t.dir(), "migrations"))
+	for _, migration := range migrations {
+		output := filepath.Join(t.dir(), "migrations", migration.Base)
+		build := fmt.Sprintf("go build -o %s %s", output, migration.File)
+
+		// Note: Build override doesn't support non-import-path migrations
+		if cfg.App.BuildCmd != "" {
+			build = fmt.Sprintf(cfg.App.BuildCmd, output, migration.File)
+		}
 
-			wg.Done()
-		}(server)
+		if option.debug {
+			println("build cmd:", build)
+		}
+		cmdEnv(t.env(), "sh", "-c", build)
 	}
-	wg.Wait()
-	time.Sleep(time.Second * 2)
 }
 
-func bundleMigration(migrations []Migration) {
-	dst, err := os.OpenFile(tmpDir+"/migrations.tar.gz", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+func bundleMigration(t buildTarget, migrations []Migration) {
+	dst, err := os.OpenFile(filepath.Join(t.dir(), "migrations.tar.gz"), os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		panic(err)
 	}
@@ -79,9 +86,9 @@ func bundleMigration(migrations []Migration) {
 	defer tarw.Close()
 
 	for _, migration := range migrations {
-		file, err := os.Open(tmpDir + "/migrations/" + migration.Base)
+		file, err := os.Open(filepath.Join(t.dir(), "migrations", migration.Base))
 		if err != nil {
-			exitf("failed to open %s/migrations/%s: %s", tmpDir, migration.Base, err)
+			exitf("failed to open %s/migrations/%s: %s", t.dir(), migration.Base, err)
 		}
 		fi, err := file.Stat()
 		if err != nil {
@@ -92,9 +99,10 @@ func bundleMigration(migrations []Migration) {
 }
 
 func (s *Server) uploadMigration(migrations []Migration) {
-	src, err := os.OpenFile(tmpDir+"/migrations.tar.gz", os.O_RDONLY, 0644)
+	dir := s.buildTarget().platform().dir()
+	src, err := os.OpenFile(filepath.Join(dir, "migrations.tar.gz"), os.O_RDONLY, 0644)
 	if err != nil {
-		exitf("failed to open %s/migrations.tar.gz: %s", tmpDir, err)
+		exitf("failed to open %s/migrations.tar.gz: %s", dir, err)
 	}
 	defer func() { src.Close() }()
 
@@ -144,26 +152,20 @@ var migrationScript = template.Must(template.New("").Parse(`set -e
 cd harp/{{$app}}
 tar mxf migrations.tar.gz
 cd {{.Path}}
+{{- /* envs are sent by stdin, so the env file of the app is kept as it is */}}
+eval "$(cat)"
 {{$gopath := .GoPath}}
 {{$home := .Home}}
 {{range .Migrations}}
 echo "running {{.Base}}"
-GOPATH="{{$gopath}}" {{.Envs}} {{$home}}/harp/{{$app}}/migration/{{.Base}} {{.Args}}
+{{if $gopath}}GOPATH="{{$gopath}}" {{end}}{{.Envs}} {{$home}}/harp/{{$app}}/migration/{{.Base}} {{.Args}}
 {{end}}
 `))
 
 // 2>&1 | tee -a {{$home}}/harp/{{$app}}/migration.log
 
 func (s *Server) runMigration(migrations []Migration) {
-	var envs string
-	for k, v := range s.Envs {
-		envs += fmt.Sprintf("%s=%s ", k, v)
-	}
-	for i := range migrations {
-		migrations[i].Envs += " " + envs
-	}
-
-	session := s.getSession()
+	session := s.newSession(0)
 	var script bytes.Buffer
 	data := struct {
 		Migrations []Migration
@@ -173,7 +175,7 @@ func (s *Server) runMigration(migrations []Migration) {
 		Home       string
 	}{
 		Migrations: migrations,
-		Path:       s.GoPath + "/src/" + cfg.App.ImportPath,
+		Path:       s.AppRoot(),
 		GoPath:     s.GoPath,
 		App:        cfg.App.Name,
 		Home:       s.Home,
@@ -205,12 +207,17 @@ func (s *Server) runMigration(migrations []Migration) {
 	scriptStr := script.String()
 	scriptStr = trimEmptyLines(scriptStr)
 	if option.debug || option.hand {
-		log.Printf("=============== (%s)\n%s===============\n", s, scriptStr)
+		log.Printf("=============== (%s)\n%s===============\n", s, redact(scriptStr))
 		if option.hand {
 			return
 		}
 	}
 
+	envs, err := envFile(s.appEnvs())
+	if err != nil {
+		s.exitf("failed to generate envs: %s", err)
+	}
+	session.Stdin = strings.NewReader(envs)
 	logSession(session)
 
 	if err := session.Run(scriptStr); err != nil {
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -46,3 +52,39 @@ func pretty(v interface{}) string {
 	}
 	return string(r)
 }
+
+func TestMigrationScript(t *testing.T) {
+	home, err := ioutil.TempDir("", "harp-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	appDir := filepath.Join(home, "harp", "app")
+	os.MkdirAll(filepath.Join(appDir, "migration"), 0755)
+	ioutil.WriteFile(filepath.Join(appDir, "migration", "m"), []byte("#!/bin/sh\necho \"$DSN|$A|$1\"\n"), 0755)
+	if out, err := exec.Command("tar", "czf", filepath.Join(appDir, "migrations.tar.gz"), "-C", appDir, "migration").CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	var script bytes.Buffer
+	err = migrationScript.Execute(&script, map[string]interface{}{
+		"Migrations": []Migration{{Base: "m", Envs: "A=1", Args: "-x"}},
+		"Path":       home,
+		"App":        "app",
+		"Home":       home,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs, _ := envFile(map[string]string{"DSN": "postgres://a:'b $c@db"})
+	cmd := exec.Command("bash", "-c", script.String())
+	cmd.Dir = home
+	cmd.Stdin = strings.NewReader(envs)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	if want := "running m\npostgres://a:'b $c@db|1|-x\n"; string(out) != want {
+		t.Errorf("output = %q; want %q", out, want)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "sync"
+
+// parallelLimit returns the max number of servers operated concurrently,
+// from -parallel or Parallel in harp.json. 0 means no limit.
+func parallelLimit() int {
+	if option.parallel > 0 {
+		return option.parallel
+	}
+	if cfg.Parallel > 0 {
+		return cfg.Parallel
+	}
+	return 0
+}
+
+// limiter is a counting semaphore.
+type limiter chan struct{}
+
+// newLimiter returns a limiter of parallelLimit, n is used if there is no
+// limit.
+func newLimiter(n int) limiter {
+	if limit := parallelLimit(); limit > 0 && limit < n {
+		n = limit
+	}
+	if n < 1 {
+		n = 1
+	}
+	return make(limiter, n)
+}
+
+func (l limiter) acquire() { l <- struct{}{} }
+func (l limiter) release() { <-l }
+
+// eachServer calls fn for servers concurrently, at most parallelLimit of
+// them at the same time. Servers are connected (and set up) in their slots
+// before fn. With a limit, connections of servers are closed once they are
+// done, so that the number of connections is also bounded.
+func eachServer(servers []*Server, fn func(i int, s *Server)) {
+	l := newLimiter(len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		l.acquire()
+		go func(i int, s *Server) {
+			defer wg.Done()
+			defer l.release()
+			s.initPathes()
+			fn(i, s)
+			if parallelLimit() > 0 {
+				s.disconnect()
+			}
+		}(i, s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEachServer(t *testing.T) {
+	oldParallel := option.parallel
+	defer func() { option.parallel = oldParallel }()
+
+	servers := make([]*Server, 10)
+	for i := range servers {
+		servers[i] = &Server{setUp: true}
+	}
+	for _, c := range []struct{ parallel, want int }{{0, 10}, {3, 3}, {20, 10}} {
+		option.parallel = c.parallel
+		var mutex sync.Mutex
+		var running, max int
+		done := make([]bool, len(servers))
+		eachServer(servers, func(i int, s *Server) {
+			mutex.Lock()
+			if running++; running > max {
+				max = running
+			}
+			mutex.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mutex.Lock()
+			running--
+			done[i] = servers[i] == s
+			mutex.Unlock()
+		})
+		if max != c.want {
+			t.Errorf("parallel %d: max concurrency = %d; want %d", c.parallel, max, c.want)
+		}
+		for i, ok := range done {
+			if !ok {
+				t.Errorf("parallel %d: server %d isn't done", c.parallel, i)
+			}
+		}
+	}
+}
+
+// TestEachServerConnections makes sure servers are connected once in their
+// slots with -parallel, i.e. one authentication per server.
+func TestEachServerConnections(t *testing.T) {
+	oldParallel, oldCfg := option.parallel, cfg
+	defer func() { option.parallel, cfg = oldParallel, oldCfg }()
+	defer removeRuntimeDir()
+	option.parallel = 2
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auths, conns, maxConns int32
+	config := &ssh.ServerConfig{PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+		atomic.AddInt32(&auths, 1)
+		return nil, nil
+	}}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveExec(conn, config, &conns, &maxConns)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	servers := make([]*Server, 5)
+	for i := range servers {
+		servers[i] = &Server{Host: host, Port: ":" + port, User: "app", Auth: []string{authPassword}, Password: "secret", HostKey: fingerprint(signer.PublicKey())}
+	}
+	initServers(servers)
+	eachServer(servers, func(_ int, s *Server) {
+		if out := s.exec("true"); !strings.Contains(out, execOutput) {
+			t.Errorf("exec: %s", out)
+		}
+	})
+	if auths != int32(len(servers)) || maxConns > 2 {
+		t.Errorf("%d authentications and %d connections at most; want %d and 2", auths, maxConns, len(servers))
+	}
+	for _, s := range servers {
+		if s.Home != "/home/app" || !s.setUp {
+			t.Errorf("%s isn't set up: %q", s, s.Home)
+		}
+	}
+}
+
+// execOutput is printed by serveExec for every command, with a banner of rc
+// files, and setup outputs of the server.
+const execOutput = "Welcome!\nHARP_HOME=/home/app\nHARP_PWD=/home/app\nHARP_GOPATH=\n"
+
+// serveExec serves ssh connection, exec requests print execOutput, and a
+// warning to stderr.
+func serveExec(conn net.Conn, config *ssh.ServerConfig, conns, maxConns *int32) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	if n := atomic.AddInt32(conns, 1); n > atomic.LoadInt32(maxConns) {
+		atomic.StoreInt32(maxConns, n)
+	}
+	defer atomic.AddInt32(conns, -1)
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range chReqs {
+				req.Reply(req.Type == "exec", nil)
+				if req.Type == "exec" {
+					ch.Write([]byte(execOutput))
+					ch.Stderr().Write([]byte("warning: no job control\n"))
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					return
+				}
+			}
+		}()
+	}
+}
@@ -27,8 +27,13 @@ func lsRollbackVersions(servers []*Server, verbose bool) {
 				os.Exit(1)
 			}
 			session.Close()
-			info := strings.Replace(string(output), "\n", "\n\t", -1)
-			log.Println("\t" + info[:len(info)-2])
+			bi, err := parseBuildInfo(string(output))
+			if err != nil {
+				log.Printf("\tfailed to parse harp-build.info: %s\n", err)
+				continue
+			}
+			info := strings.Replace(strings.TrimSpace(bi.String()), "\n", "\n\t", -1)
+			log.Println("\t" + info)
 		}
 	}
 }
@@ -66,11 +71,12 @@ func (s *Server) trimOldReleases() {
 	s.initPathes()
 	releases := s.retrieveAllReleases()
 
-	if len(releases) <= cfg.RollbackCount {
+	count := s.rollbackCount()
+	if len(releases) <= count {
 		return
 	}
 
-	for _, release := range releases[:len(releases)-cfg.RollbackCount] {
+	for _, release := range releases[:len(releases)-count] {
 		session := s.getSession()
 		script := fmt.Sprintf("rm -rf %s/harp/%s/releases/%s", s.Home, cfg.App.Name, release)
 		if option.debug {
@@ -102,3 +108,17 @@ func (s *Server) retrieveAllReleases() []string {
 
 	return releases
 }
+
+// rollbackEnabled reports whether releases are saved on any of the server
+// sets, as NoRollback could be overridden by server sets.
+func rollbackEnabled() bool {
+	if !cfg.NoRollback {
+		return true
+	}
+	for _, set := range cfg.ServerSets {
+		if set.NoRollback != nil && !*set.NoRollback {
+			return true
+		}
+	}
+	return false
+}
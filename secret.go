@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DisposaBoy/JsonConfigReader"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// secretPrefix marks values encrypted by NaCl secretbox.
+	secretPrefix = "enc:v1:"
+	// secretRefPrefix marks values referencing a secret in Config.Secrets.
+	secretRefPrefix = "secret:"
+)
+
+// secretKeyPath returns path of the secret key file, relative to harp.json.
+func secretKeyPath() string {
+	path := expandHome(firstNonEmpty(cfg.SecretKeyFile, "harp.key"))
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(option.configPath), path)
+	}
+	return path
+}
+
+var (
+	secretKeyMutex sync.Mutex
+	secretKey      *[32]byte
+)
+
+// loadSecretKey loads secret key from HARP_SECRET_KEY or the key file. A new
+// key file is created if it doesn't exist and create is true.
+func loadSecretKey(create bool) *[32]byte {
+	secretKeyMutex.Lock()
+	defer secretKeyMutex.Unlock()
+	if secretKey != nil {
+		return secretKey
+	}
+
+	encoded := os.Getenv("HARP_SECRET_KEY")
+	source := "HARP_SECRET_KEY"
+	if encoded == "" {
+		source = secretKeyPath()
+		data, err := ioutil.ReadFile(source)
+		switch {
+		case os.IsNotExist(err) && create:
+			var key [32]byte
+			if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+				exitf("failed to generate secret key: %s", err)
+			}
+			encoded = base64.StdEncoding.EncodeToString(key[:])
+			if err := ioutil.WriteFile(source, []byte(encoded+"\n"), 0600); err != nil {
+				exitf("failed to save secret key: %s", err)
+			}
+			fmt.Fprintf(os.Stderr, "created secret key %s, keep it safe and out of version control\n", source)
+		case err != nil:
+			exitf("failed to read secret key (HARP_SECRET_KEY or SecretKeyFile): %s", err)
+		default:
+			encoded = string(data)
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		exitf("bad secret key in %s: a base64 encoded 32-byte key is expected", source)
+	}
+	secretKey = new([32]byte)
+	copy(secretKey[:], key)
+	return secretKey
+}
+
+func encryptSecret(key *[32]byte, plaintext string) (string, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+	box := secretbox.Seal(nonce[:], []byte(plaintext), &nonce, key)
+	return secretPrefix + base64.StdEncoding.EncodeToString(box), nil
+}
+
+func decryptSecret(key *[32]byte, value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return "", errors.New("not an encrypted value")
+	}
+	box, err := base64.StdEncoding.DecodeString(value[len(secretPrefix):])
+	if err != nil {
+		return "", err
+	}
+	if len(box) < 24+secretbox.Overhead {
+		return "", errors.New("encrypted value is too short")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box)
+	plaintext, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return "", errors.New("failed to decrypt, wrong secret key?")
+	}
+	return string(plaintext), nil
+}
+
+// revealSecret returns plaintext of encrypted values (enc:v1:...) and
+// references of Secrets (secret:name or ${secret:name} in values), other
+// values are returned as they are. Plaintexts are kept in memory only, and
+// redacted in outputs.
+func revealSecret(val string) string {
+	if strings.Contains(val, "${"+secretRefPrefix) {
+		return revealSecretRefs(val)
+	}
+	name := "value"
+	switch {
+	case strings.HasPrefix(val, secretRefPrefix):
+		name = strings.TrimPrefix(val, secretRefPrefix)
+		enc, ok := cfg.Secrets[name]
+		if !ok {
+			exitf("secret %s is not found in Secrets", name)
+		}
+		val = enc
+	case !strings.HasPrefix(val, secretPrefix):
+		return val
+	}
+	plaintext, err := decryptSecret(loadSecretKey(false), val)
+	if err != nil {
+		exitf("failed to decrypt secret %s: %s", name, err)
+	}
+	addRedaction(plaintext)
+	return plaintext
+}
+
+// revealEnvs returns a copy of envs with secrets revealed.
+func revealEnvs(envs map[string]string) map[string]string {
+	revealed := map[string]string{}
+	for k, v := range envs {
+		revealed[k] = revealSecret(v)
+	}
+	return revealed
+}
+
+var redactions = struct {
+	sync.Mutex
+	values []string
+}{}
+
+func addRedaction(val string) {
+	if val == "" {
+		return
+	}
+	redactions.Lock()
+	defer redactions.Unlock()
+	for _, v := range redactions.values {
+		if v == val {
+			return
+		}
+	}
+	redactions.values = append(redactions.values, val)
+	// replace longer secrets first, in case of secrets containing others
+	sort.Slice(redactions.values, func(i, j int) bool { return len(redactions.values[i]) > len(redactions.values[j]) })
+}
+
+// redact hides revealed secrets in str, for printing scripts and errors.
+func redact(str string) string {
+	redactions.Lock()
+	defer redactions.Unlock()
+	for _, v := range redactions.values {
+		str = strings.Replace(str, v, "******", -1)
+	}
+	return str
+}
+
+func secretCmd(args []string) {
+	if len(args) == 0 {
+		exitf("usage: harp secret set NAME [VALUE] | get NAME | edit")
+	}
+	switch {
+	case args[0] == "set" && (len(args) == 2 || len(args) == 3):
+		var val string
+		if len(args) == 3 {
+			val = args[2]
+		} else {
+			val = readSecretValue(args[1])
+		}
+		enc, err := encryptSecret(loadSecretKey(true), val)
+		if err != nil {
+			exitf("failed to encrypt: %s", err)
+		}
+		quoted, _ := json.Marshal(enc)
+		updateConfigFile(func(data []byte) ([]byte, error) {
+			return setJSONObjectField(data, []string{"Secrets"}, args[1], quoted)
+		}, map[string]string{args[1]: enc})
+	case args[0] == "get" && len(args) == 2:
+		enc, ok := cfg.Secrets[args[1]]
+		if !ok {
+			exitf("secret %s is not found", args[1])
+		}
+		plaintext, err := decryptSecret(loadSecretKey(false), enc)
+		if err != nil {
+			exitf("failed to decrypt secret %s: %s", args[1], err)
+		}
+		fmt.Println(plaintext)
+	case args[0] == "edit" && len(args) == 1:
+		editSecrets()
+	default:
+		exitf("usage: harp secret set NAME [VALUE] | get NAME | edit")
+	}
+}
+
+// readSecretValue reads secret from terminal without echo, or from stdin.
+func readSecretValue(name string) string {
+	if isTerminal() {
+		val, err := promptSecret(fmt.Sprintf("value of %s: ", name))
+		if err != nil {
+			exitf("failed to read secret: %s", err)
+		}
+		return val
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		exitf("failed to read secret: %s", err)
+	}
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// editSecrets opens decrypted secrets in $EDITOR, and saves them encrypted.
+// Unchanged secrets keep their encrypted values.
+func editSecrets() {
+	key := loadSecretKey(true)
+	plaintexts := map[string]string{}
+	for name, enc := range cfg.Secrets {
+		plaintext, err := decryptSecret(key, enc)
+		if err != nil {
+			exitf("failed to decrypt secret %s: %s", name, err)
+		}
+		plaintexts[name] = plaintext
+	}
+
+	path := filepath.Join(runtimeDir(), "secrets.json")
+	data, _ := json.MarshalIndent(plaintexts, "", "\t")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		exitf("failed to write %s: %s", path, err)
+	}
+	defer os.Remove(path)
+
+	editor := firstNonEmpty(os.Getenv("VISUAL"), os.Getenv("EDITOR"), "vi")
+	cmd := exec.Command("sh", "-c", editor+" "+shellQuote(path))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		exitf("failed to edit secrets: %s", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		exitf("failed to read %s: %s", path, err)
+	}
+	defer file.Close()
+	var edited map[string]string
+	if err := json.NewDecoder(JsonConfigReader.New(file)).Decode(&edited); err != nil {
+		exitf("failed to parse edited secrets: %s", err)
+	}
+
+	secrets := map[string]string{}
+	var changed bool
+	for name, plaintext := range edited {
+		if old, ok := plaintexts[name]; ok && old == plaintext {
+			secrets[name] = cfg.Secrets[name]
+			continue
+		}
+		changed = true
+		if secrets[name], err = encryptSecret(key, plaintext); err != nil {
+			exitf("failed to encrypt: %s", err)
+		}
+	}
+	if !changed && len(edited) == len(plaintexts) {
+		fmt.Println("secrets are not changed")
+		return
+	}
+
+	value, _ := json.MarshalIndent(secrets, "\t", "\t")
+	updateConfigFile(func(data []byte) ([]byte, error) {
+		return setJSONObjectField(data, nil, "Secrets", value)
+	}, secrets)
+}
+
+// updateConfigFile rewrites the JSON config file by update, keeping file
+// mode. YAML and TOML configs are not rewritten, as their comments and key
+// order would be lost in the round trip; secrets are printed in the format
+// of the config instead, for users to add them by themselves.
+func updateConfigFile(update func(data []byte) ([]byte, error), secrets map[string]string) {
+	path := option.configPath
+	if format := configFormat(path); format != formatJSON {
+		conf := map[string]interface{}{}
+		for name, enc := range secrets {
+			conf[name] = enc
+		}
+		data, err := encodeConfig(format, map[string]interface{}{"Secrets": conf})
+		if err != nil {
+			exitf("failed to encode secrets: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "harp doesn't rewrite %s config %s, as its comments and key order would be lost.\nPlease update Secrets in it with:\n\n", strings.ToUpper(format), path)
+		fmt.Print(string(data))
+		os.Exit(1)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		exitf("failed to stat %s: %s", path, err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		exitf("failed to read %s: %s", path, err)
+	}
+	if data, err = update(data); err != nil {
+		exitf("failed to update %s: %s", path, err)
+	}
+	if err := json.NewDecoder(JsonConfigReader.New(bytes.NewReader(data))).Decode(&Config{}); err != nil {
+		exitf("failed to update %s: broken result: %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, data, fi.Mode()); err != nil {
+		exitf("failed to write %s: %s", path, err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSecret(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	enc, err := encryptSecret(key, "p@ss word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decryptSecret(key, enc); err != nil || got != "p@ss word" {
+		t.Errorf("decryptSecret = %q, %v", got, err)
+	}
+	if _, err := decryptSecret(&[32]byte{4}, enc); err == nil {
+		t.Error("decrypted with a wrong key")
+	}
+	if _, err := decryptSecret(key, "plain"); err == nil {
+		t.Error("decrypted a plain value")
+	}
+
+	oldCfg, oldKey := cfg, secretKey
+	defer func() { cfg, secretKey = oldCfg, oldKey }()
+	secretKey = key
+	cfg.Secrets = map[string]string{"db_dsn": enc}
+	envs := revealEnvs(map[string]string{"A": "secret:db_dsn", "B": enc, "C": "plain", "D": "db://u:${secret:db_dsn}@h"})
+	if envs["A"] != "p@ss word" || envs["B"] != "p@ss word" || envs["C"] != "plain" || envs["D"] != "db://u:p@ss word@h" {
+		t.Errorf("unexpected envs: %v", envs)
+	}
+	if got, want := redact(`DB="p@ss word" C="plain"`), `DB="******" C="plain"`; got != want {
+		t.Errorf("redact = %s; want %s", got, want)
+	}
+}
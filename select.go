@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// selector matches tags of servers, e.g. "region=eu,role!=cron" selects
+// servers tagged region=eu but not role=cron. Terms are ANDed: key=value,
+// key!=value, key (tagged) and !key (not tagged).
+type selector []selectorTerm
+
+type selectorTerm struct {
+	key, val string
+	not      bool // != or !key
+	exists   bool // key or !key
+}
+
+func parseSelector(str string) (selector, error) {
+	var sel selector
+	for _, term := range strings.Split(str, ",") {
+		term = strings.TrimSpace(term)
+		var t selectorTerm
+		switch {
+		case strings.Contains(term, "!="):
+			i := strings.Index(term, "!=")
+			t = selectorTerm{key: term[:i], val: term[i+2:], not: true}
+		case strings.Contains(term, "="):
+			i := strings.Index(term, "=")
+			t = selectorTerm{key: term[:i], val: term[i+1:]}
+		case strings.HasPrefix(term, "!"):
+			t = selectorTerm{key: term[1:], not: true, exists: true}
+		default:
+			t = selectorTerm{key: term, exists: true}
+		}
+		t.key, t.val = strings.TrimSpace(t.key), strings.TrimSpace(t.val)
+		if t.key == "" {
+			return nil, fmt.Errorf("bad selector %q: empty tag name", str)
+		}
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+func (sel selector) match(s *Server) bool {
+	for _, t := range sel {
+		val, ok := s.Tags[t.key]
+		matched := ok
+		if !t.exists {
+			matched = ok && val == t.val
+		}
+		if matched == t.not {
+			return false
+		}
+	}
+	return true
+}
+
+// setServers returns servers of the server set, including the ones of the
+// sets it's composed of (ServerSet.Sets). parents are the composing sets,
+// for detecting cycles.
+func setServers(name string, parents []string) ([]*Server, error) {
+	for _, p := range parents {
+		if p == name {
+			return nil, fmt.Errorf("server set %s is composed of itself: %s", name, strings.Join(append(parents, name), " -> "))
+		}
+	}
+	loadInventories([]string{name})
+	servers, ok := cfg.Servers[name]
+	set := cfg.ServerSets[name]
+	if set == nil || len(set.Sets) == 0 {
+		if !ok {
+			return nil, fmt.Errorf("server set doesn't exist: %s (%s)", name, strings.Join(serverSetNames(), ", "))
+		}
+		return servers, nil
+	}
+	servers = append([]*Server{}, servers...)
+	for _, sub := range set.Sets {
+		subServers, err := setServers(sub, append(parents, name))
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, subServers...)
+	}
+	return servers, nil
+}
+
+// findServer returns the server of the ID or User@Host:Port in config,
+// servers in inventories are loaded only if necessary.
+func findServer(name string) *Server {
+	find := func() *Server {
+		for _, set := range sortedSetNames(cfg.Servers) {
+			for _, s := range cfg.Servers[set] {
+				if name == s.String() || name == s.ID {
+					return s
+				}
+			}
+		}
+		return nil
+	}
+	if s := find(); s != nil {
+		return s
+	}
+	loadInventories(serverSetNames())
+	return find()
+}
+
+// knownServerNames returns IDs (or User@Host:Port) of servers in the config.
+func knownServerNames() []string {
+	var names []string
+	for _, set := range sortedSetNames(cfg.Servers) {
+		for _, s := range cfg.Servers[set] {
+			names = append(names, firstNonEmpty(s.ID, s.String()))
+		}
+	}
+	return names
+}
+
+// filterServers removes duplicated servers, servers not matching any of the
+// selectors (if any) and the excluded ones (IDs or User@Host:Port).
+func filterServers(servers []*Server, selectors []string, excludes []string) ([]*Server, error) {
+	var sels []selector
+	for _, str := range selectors {
+		sel, err := parseSelector(str)
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+
+	excluded := map[*Server]bool{}
+	for _, str := range excludes {
+		for _, name := range strings.Split(str, ",") {
+			name = strings.TrimSpace(name)
+			found := false
+			for _, s := range servers {
+				if name == s.String() || name == s.ID {
+					excluded[s] = true
+					found = true
+				}
+			}
+			if !found && findServer(name) == nil {
+				// likely a typo, which might let the action run on the
+				// server meant to be excluded
+				return nil, fmt.Errorf("excluded server doesn't exist: %s", name)
+			}
+		}
+	}
+
+	var filtered []*Server
+	seen := map[*Server]bool{}
+	for _, s := range servers {
+		if seen[s] || excluded[s] {
+			continue
+		}
+		seen[s] = true
+		matched := len(sels) == 0
+		for _, sel := range sels {
+			if sel.match(s) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			filtered = append(filtered, s)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, errors.New("no servers are selected")
+	}
+	return filtered, nil
+}
+
+// selectServers returns servers specified by flags -s, -server and -all,
+// filtered by -select and -exclude. -select alone selects from all servers.
+func selectServers() []*Server {
+	serverSets := option.serverSets
+	servers := option.servers
+
+	if option.all || (len(servers) == 0 && len(serverSets) == 0 && len(option.selects) > 0) {
+		serverSets = serverSetNames()
+	}
+
+	if len(servers) == 0 && len(serverSets) == 0 {
+		println("please specify servers or server sets to deploy (-s, -server or -select).")
+		println("specify -all flag to execute the action on all servers.")
+		os.Exit(1)
+	}
+
+	var targetServers []*Server
+	for _, set := range serverSets {
+		servers, err := setServers(set, nil)
+		if err != nil {
+			exitf("%s", err)
+		}
+		targetServers = append(targetServers, servers...)
+	}
+
+	for _, server := range servers {
+		if s := findServer(server); s != nil {
+			targetServers = append(targetServers, s)
+			continue
+		}
+
+		// one-shot servers
+		if s := newOneShotServer(server); s != nil {
+			targetServers = append(targetServers, s)
+		} else {
+			exitf("server %s is not found, known servers: %s\n(one-shot servers are specified as user@host:port, an address, or a host alias in ssh config)", server, strings.Join(knownServerNames(), ", "))
+		}
+	}
+
+	targetServers, err := filterServers(targetServers, option.selects, option.excludes)
+	if err != nil {
+		exitf("%s", err)
+	}
+	return targetServers
+}
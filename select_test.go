@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectServers(t *testing.T) {
+	oldCfg, oldOption := cfg, option
+	defer func() { cfg, option = oldCfg, oldOption }()
+	cfg = Config{
+		Servers: map[string][]*Server{
+			"eu": {
+				{ID: "eu-1", Host: "h1", Tags: map[string]string{"role": "web"}},
+				{ID: "eu-2", Host: "h2", Tags: map[string]string{"role": "cron"}},
+			},
+			"us": {
+				{ID: "us-1", Host: "h3", Tags: map[string]string{"role": "web", "canary": ""}},
+			},
+		},
+		ServerSets: map[string]*ServerSet{
+			"eu":  {Defaults: &Server{Tags: map[string]string{"region": "eu"}}},
+			"all": {Sets: []string{"eu", "us"}},
+		},
+	}
+	for name, servers := range cfg.Servers {
+		for _, s := range servers {
+			cfg.setUpServer(s, name)
+		}
+	}
+
+	option.all, option.servers = false, nil
+	for _, c := range []struct {
+		sets, selects, excludes []string
+		want                    []string
+	}{
+		{sets: []string{"all", "eu"}, want: []string{"eu-1", "eu-2", "us-1"}},
+		{sets: []string{"all"}, excludes: []string{"eu-2, us-1"}, want: []string{"eu-1"}},
+		{selects: []string{"region=eu,role!=cron"}, want: []string{"eu-1"}},
+		{selects: []string{"!region"}, want: []string{"us-1"}},
+		{selects: []string{"canary", "role=cron"}, want: []string{"eu-2", "us-1"}},
+		{sets: []string{"us"}, selects: []string{"role=web"}, want: []string{"us-1"}},
+	} {
+		option.serverSets, option.selects, option.excludes = c.sets, c.selects, c.excludes
+		var got []string
+		for _, s := range selectServers() {
+			got = append(got, s.ID)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("-s %q -select %q -exclude %q = %q; want %q", c.sets, c.selects, c.excludes, got, c.want)
+		}
+	}
+
+	cfg.ServerSets["eu"].Sets = []string{"all"}
+	if _, err := setServers("all", nil); err == nil {
+		t.Error("composing cycle is not detected")
+	}
+	if _, err := filterServers(cfg.Servers["eu"], nil, []string{"eu-3"}); err == nil {
+		t.Error("unknown excluded server is accepted")
+	}
+}
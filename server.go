@@ -4,51 +4,97 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime/debug"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
 type Server struct {
 	ID string
 
+	// Tags are labels for selecting servers by -select, e.g.
+	// {"region": "eu", "role": "web"}. Tags in Defaults are merged.
+	Tags map[string]string
+
 	Envs map[string]string
 	// Args   []string // TODO: support
 
 	Home   string
 	GoPath string
 	LogDir string
+
+	// AppDir overrides App.AppDir for this server.
+	AppDir string
 	// PIDDir string
 
 	User string
 	Host string
 	Port string
 
-	// TODO
-	Password string
+	// Auth lists ssh authentication methods in the order of trying:
+	// agent, key, password and keyboard-interactive. Default: all of them.
+	Auth []string
+	// Key is the path of private key file. KeyEnv is the environment
+	// variable containing private key, default: HARP_SSH_KEY.
+	Key    string
+	KeyEnv string
+	// PassphraseEnv is the environment variable containing passphrase of
+	// encrypted keys, default: HARP_SSH_PASSPHRASE. Harp prompts for it if
+	// it's empty.
+	PassphraseEnv string
+	// Password is used in password and keyboard-interactive authentications.
+	// PasswordEnv is the environment variable containing password, default:
+	// HARP_SSH_PASSWORD. Harp prompts for it if both are empty.
+	Password    string
+	PasswordEnv string
+
+	// HostKey pins SHA256 fingerprint of host key (ssh-keygen -lf), which
+	// takes precedence over known_hosts.
+	HostKey string
 
 	Set string // aka, Type
 
+	source string // where the server is defined if not in Servers, e.g. inventory
+
+	// Build target overrides, see ServerSet.
+	GOOS, GOARCH string
+	BuildArgs    string
+	BuildTags    string
+
 	client *ssh.Client
+	// setUp is true once initPathes is done.
+	setUp bool
+	// prompted is true if keyboard-interactive questions other than
+	// password (e.g. OTP) were answered by user, which rsync can't answer.
+	prompted bool
 
-	Config *Config
+	Config *Config `json:"-"`
 
+	// Proxy is the bastion host to connect the server through, which could
+	// have its own Proxy. Default: ServerSet.Proxy or ProxyJump in ssh config.
 	Proxy *Server
+
+	// resolved from ssh config
+	resolved      bool
+	hostname      string
+	identityFiles []string
+	aliveInterval time.Duration
+	hops          int // number of servers behind the proxy
 }
 
-var urlRegexp = regexp.MustCompile(`(?P<user>[^@]+)@(?P<host>[^:]+)(?P<port>:.*)?`)
+var urlRegexp = regexp.MustCompile(`^(?:(?P<user>[^@]+)@)?(?P<host>[^:@]+)(?P<port>:.*)?$`)
 var testMode bool
 
+// newOneShotServer parses user@host:port for -server. A bare host is only
+// accepted if it's a Host alias in ssh config or looks like an address, so
+// that mistyped server IDs are not dialed.
 func newOneShotServer(url string) *Server {
 	if !urlRegexp.MatchString(url) {
 		return nil
@@ -58,47 +104,36 @@ func newOneShotServer(url string) *Server {
 	s.User = matches[1]
 	s.Host = matches[2]
 	s.Port = matches[3]
-	if s.Port == "" {
-		s.Port = ":22"
-	}
-
-	if !testMode {
-		s.init()
+	if s.User == "" && s.Port == "" && !isHostAddr(s.Host) && !loadSSHConfig().hasAlias(s.Host) {
+		return nil
 	}
 
 	return &s
 }
 
+// isHostAddr reports whether host looks like an IPv4 address, a domain name
+// with dots or localhost (IPv6 addresses are not supported by urlRegexp).
+func isHostAddr(host string) bool {
+	return strings.Contains(host, ".") || host == "localhost"
+}
+
 func (s *Server) init() {
 	s.Config = &cfg
-	if s.User == "" {
-		fmt.Printf("%s contains server with empty user name\n", s.Set)
-		os.Exit(1)
-	} else if s.Host == "" {
+	if s.Host == "" {
 		fmt.Printf("%s contains server with empty host\n", s.Set)
 		os.Exit(1)
 	}
-	if s.Port == "" {
-		s.Port = ":22"
-	}
-
-	s.initSetUp()
-	s.initPathes()
+	s.resolve()
 }
 
 // TODO: pipelining output instead of being silent
 // copy files into tmp/harp/
 // exclude files
 func (s *Server) upload(info string) {
-	// rsync -av -e 'ssh -o "ProxyCommand ssh -p port bastion-dev@proxy exec nc %h %p 2>/dev/null"' test.txt app@target:~/
-	// rsync -avrP -e 'ssh -o ProxyCommand="ssh -W %h:%p bastion-dev@proxy -p port"' test.txt app@target:~/
-	ssh := fmt.Sprintf(`ssh -l %s -p %s`, s.User, strings.TrimLeft(s.Port, ":"))
-	if s.Proxy != nil {
-		ssh = fmt.Sprintf(`ssh -o ProxyCommand="ssh -W %%h:%%p %s@%s -p %s"`, s.Proxy.User, s.Proxy.Host, strings.TrimLeft(s.Proxy.Port, ":"))
-	}
+	ssh := s.rsyncSSH()
 
 	appName := cfg.App.Name
-	dst := fmt.Sprintf("%s@%s:%s/harp/%s/", s.User, s.Host, s.Home, appName)
+	dst := fmt.Sprintf("%s:%s/harp/%s/", s.Host, s.Home, appName)
 	// if option.debug {
 	// 	fmt.Println("rsync", "-az", "--delete", "-e", ssh, filepath.Join(tmpDir, appName), filepath.Join(tmpDir, "files"), dst)
 	// }
@@ -107,7 +142,7 @@ func (s *Server) upload(info string) {
 		args = append(args, "-P")
 	}
 	if !option.noBuild {
-		args = append(args, filepath.Join(tmpDir, appName))
+		args = append(args, s.buildTarget().output())
 	}
 	if !option.noFiles {
 		args = append(args, filepath.Join(tmpDir, "files"))
@@ -115,7 +150,13 @@ func (s *Server) upload(info string) {
 	if option.debug {
 		fmt.Println("upload cmd:", strings.Join(append([]string{"rsync"}, append(args, dst)...), " "))
 	}
+	for p := s; p != nil; p = p.Proxy {
+		if p.prompted {
+			s.exitf("failed to sync binary %s: rsync can't answer keyboard-interactive questions of %s, please use key or password authentication", appName, p)
+		}
+	}
 	cmd := exec.Command("rsync", append(args, dst)...)
+	cmd.Env = append(append(os.Environ(), rsyncEnv()...), s.askpassEnv()...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	err := cmd.Run()
@@ -124,7 +165,7 @@ func (s *Server) upload(info string) {
 	}
 
 	session := s.getSession()
-	output, err := session.CombinedOutput(fmt.Sprintf("cat <<EOF > %s/harp/%s/harp-build.info\n%s\nEOF", s.Home, appName, info))
+	output, err := session.CombinedOutput(fmt.Sprintf("cat <<'EOF' > %s/harp/%s/harp-build.info\n%s\nEOF", s.Home, appName, info))
 	if err != nil {
 		s.exitf("failed to save build info: %s: %s", err, string(output))
 	}
@@ -137,6 +178,7 @@ func (s *Server) deploy() {
 	// }
 
 	// TODO: save scripts(s) for kill app
+	s.saveEnvFile()
 	s.saveScript("restart", s.retrieveRestartScript(""))
 	s.saveScript("kill", s.retrieveKillScript(""))
 	s.saveScript("rollback", s.retrieveRollbackScript())
@@ -147,14 +189,14 @@ func (s *Server) deploy() {
 
 	script := s.retrieveDeployScript()
 	if option.debug {
-		fmt.Printf("%s", script)
+		fmt.Printf("%s", redact(script))
 	}
 	if output, err := session.CombinedOutput(script); err != nil {
 		s.exitf("failed to exec %s: %s %s", script, string(output), err)
 	}
 
 	// clean older releases
-	if !cfg.NoRollback {
+	if !s.noRollback() {
 		s.trimOldReleases()
 	}
 }
@@ -170,14 +212,14 @@ func (s *Server) scriptData(typ, who, checksum string) interface{} {
 }
 
 func (s *Server) syncFilesScript() (script string) {
-	script += fmt.Sprintf("mkdir -p %s/bin %s/src %s/src/%s\n", s.GoPath, s.GoPath, s.GoPath, cfg.App.ImportPath)
+	script += fmt.Sprintf("mkdir -p %s %s\n", filepath.Dir(s.BinPath()), s.AppRoot())
 
 	// TODO: handle callback error
 	for _, dstf := range cfg.App.Files {
 		dst := dstf.Path
 		src := fmt.Sprintf("%s/harp/%s/files/%s", s.Home, cfg.App.Name, strings.Replace(dst, "/", "_", -1))
 		odst := dst
-		dst = fmt.Sprintf("%s/src/%s", s.GoPath, dst)
+		dst = s.FilePath(dst)
 
 		var hasErr bool
 		for _, path := range GoPaths {
@@ -205,9 +247,9 @@ func (s *Server) syncFilesScript() (script string) {
 		script += fmt.Sprintf("rsync -az %s %s \"%s\" \"%s\"\n", delete, strings.Join(excludes, " "), src, dst)
 	}
 
-	script += fmt.Sprintf("cp %s/harp/%s/harp-build.info %s/src/%s/\n", s.Home, cfg.App.Name, s.GoPath, cfg.App.ImportPath)
+	script += fmt.Sprintf("cp %s/harp/%s/harp-build.info %s\n", s.Home, cfg.App.Name, s.AppRoot())
 	// rsync += fmt.Sprintf("rsync -az --delete harp/%[1]s/%[1]s %s/bin/%[1]s\n", cfg.App.Name, s.GoPath)
-	script += fmt.Sprintf("rsync -az %s/harp/%[2]s/%[2]s %[3]s/bin/%[2]s\n", s.Home, cfg.App.Name, s.GoPath)
+	script += fmt.Sprintf("rsync -az %s/harp/%[2]s/%[2]s %[3]s\n", s.Home, cfg.App.Name, s.BinPath())
 
 	if script[len(script)-1] == '\n' {
 		script = script[:len(script)-1]
@@ -229,13 +271,41 @@ func (s *Server) LogPath() string { return filepath.Join(s.GetLogDir(), "app.log
 // HistoryLogPath returns deployment, kill, and restart history file path.
 func (s *Server) HistoryLogPath() string { return filepath.Join(s.GetLogDir(), "history.log") }
 
+// LogFIFOPath returns path of the fifo between the app and the log writer,
+// see LogRotate.
+func (s *Server) LogFIFOPath() string {
+	return fmt.Sprintf("%s/harp/%s/app.log.fifo", s.Home, cfg.App.Name)
+}
+
+// LogWriterPIDPath returns PID file path of the log writer.
+func (s *Server) LogWriterPIDPath() string {
+	return fmt.Sprintf("%s/harp/%s/app.log.writer.pid", s.Home, cfg.App.Name)
+}
+
+// logWriterWaitScriptTmpl waits (up to 30s) for the previous app and its log
+// writer to exit, so that only one writer appends to and rotates app.log. A
+// writer still running after that is killed. $target is the previous app.
+var logWriterWaitScriptTmpl = template.Must(template.New("").Parse(`writer=$(cat {{.LogWriterPIDPath}} 2>/dev/null)
+for i in $(seq 300); do
+	alive=
+	for p in $target $writer; do
+		kill -0 $p 2>/dev/null && alive=1
+	done
+	[[ -z $alive ]] && break
+	sleep 0.1
+done
+if [[ -n $alive && -n $writer ]]; then
+	kill $writer 2>/dev/null
+fi
+`))
+
 // PIDPath returns PID file path.
 func (s *Server) PIDPath() string { return fmt.Sprintf("%s/harp/%s/app.pid", s.Home, cfg.App.Name) }
 
 var restartScriptTmpl = template.Must(template.New("").Parse(`if [[ -f {{.PIDPath}} ]]; then
 	target=$(cat {{.PIDPath}});
 	if ps -p $target > /dev/null; then
-		kill -{{.Config.App.KillSig}} $target; > /dev/null 2>&1;
+		kill -{{.KillSig}} $target; > /dev/null 2>&1;
 	fi
 fi
 mkdir -p {{.GetLogDir}}
@@ -253,16 +323,10 @@ func (s *Server) restartScript(typ, who, checksum string) (script string) {
 	}
 	script += buf.String()
 
-	envs := fmt.Sprintf(`%s=%q`, "GOPATH", s.GoPath)
-	for k, v := range app.Envs {
-		envs += fmt.Sprintf(` %s="%s"`, k, v)
-	}
-	for k, v := range s.Envs {
-		envs += fmt.Sprintf(` %s="%s"`, k, v)
-	}
 	args := strings.Join(app.Args, " ")
-	script += fmt.Sprintf("cd %s/src/%s\n", s.GoPath, app.ImportPath)
-	// env=val nohup $GOPATH/bin/$app arg1 >> $log 2&1 &
+	script += s.envFileScript()
+	script += fmt.Sprintf("cd %s\n", s.AppRoot())
+	// nohup $GOPATH/bin/$app arg1 >> $log 2&1 &
 
 	script += s.GetHarpComposer(who)
 
@@ -273,12 +337,129 @@ func (s *Server) restartScript(typ, who, checksum string) (script string) {
 		`echo "[harp] {\"datetime\": \"$(date)\", \"user\": \"$harp_composer\", \"type\": \"%s\"%s}" | tee -a %s %s >/dev/null`+"\n",
 		typ, checksum, log, s.HistoryLogPath(),
 	)
-	script += fmt.Sprintf("%s nohup %s/bin/%s %s $@ >> %s 2>&1 &\n", envs, s.GoPath, app.Name, args, log)
+	if app.LogRotate != nil {
+		// the writer reads outputs of the app from a fifo, and is detached
+		// by nohup too, so that both survive the exit of the shell.
+		var wait bytes.Buffer
+		if err := logWriterWaitScriptTmpl.Execute(&wait, s); err != nil {
+			s.exitf("failed to execute logWriterWaitScriptTmpl: %s", err)
+		}
+		script += wait.String()
+		fifo := s.LogFIFOPath()
+		script += fmt.Sprintf("rm -f %[1]s && mkfifo -m 600 %[1]s\n", fifo)
+		script += fmt.Sprintf("nohup %s < %s > /dev/null 2>&1 &\n", s.logWriterScript(), fifo)
+		script += fmt.Sprintf("echo $! > %s\n", s.LogWriterPIDPath())
+		script += fmt.Sprintf("nohup %s %s $@ > %s 2>&1 &\n", s.BinPath(), args, fifo)
+	} else {
+		script += fmt.Sprintf("nohup %s %s $@ >> %s 2>&1 &\n", s.BinPath(), args, log)
+	}
 	script += fmt.Sprintf("echo $! > %s\n", pid)
 	script += "cd " + s.Home
 	return
 }
 
+// serverSet returns settings of the server set that the server belongs to.
+func (s *Server) serverSet() *ServerSet {
+	if set := cfg.ServerSets[s.Set]; set != nil {
+		return set
+	}
+	return &ServerSet{}
+}
+
+// inherit fills up empty settings of the server by defaults. Tags are
+// merged, the ones of the server take precedence. Envs are not inherited,
+// they are layers of appEnvs.
+func (s *Server) inherit(defaults *Server) {
+	if defaults == nil {
+		return
+	}
+	if len(defaults.Tags) > 0 {
+		s.Tags = mergeStrings(defaults.Tags, s.Tags)
+	}
+	s.Home = firstNonEmpty(s.Home, defaults.Home)
+	s.GoPath = firstNonEmpty(s.GoPath, defaults.GoPath)
+	s.LogDir = firstNonEmpty(s.LogDir, defaults.LogDir)
+	s.AppDir = firstNonEmpty(s.AppDir, defaults.AppDir)
+	s.User = firstNonEmpty(s.User, defaults.User)
+	s.Port = firstNonEmpty(s.Port, defaults.Port)
+	if len(s.Auth) == 0 {
+		s.Auth = defaults.Auth
+	}
+	s.Key = firstNonEmpty(s.Key, defaults.Key)
+	s.KeyEnv = firstNonEmpty(s.KeyEnv, defaults.KeyEnv)
+	s.PassphraseEnv = firstNonEmpty(s.PassphraseEnv, defaults.PassphraseEnv)
+	s.Password = firstNonEmpty(s.Password, defaults.Password)
+	s.PasswordEnv = firstNonEmpty(s.PasswordEnv, defaults.PasswordEnv)
+	s.GOOS = firstNonEmpty(s.GOOS, defaults.GOOS)
+	s.GOARCH = firstNonEmpty(s.GOARCH, defaults.GOARCH)
+	s.BuildArgs = firstNonEmpty(s.BuildArgs, defaults.BuildArgs)
+	s.BuildTags = firstNonEmpty(s.BuildTags, defaults.BuildTags)
+	if s.Proxy == nil {
+		s.Proxy = defaults.Proxy
+	}
+}
+
+// mergeStrings returns a new map of base overlaid by overlay.
+func mergeStrings(base, overlay map[string]string) map[string]string {
+	m := map[string]string{}
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range overlay {
+		m[k] = v
+	}
+	return m
+}
+
+// noRollback returns NoRollback of the server set or the config.
+func (s *Server) noRollback() bool {
+	if p := s.serverSet().NoRollback; p != nil {
+		return *p
+	}
+	return cfg.NoRollback
+}
+
+// rollbackCount returns RollbackCount of the server set or the config.
+func (s *Server) rollbackCount() int {
+	if n := s.serverSet().RollbackCount; n > 0 {
+		return n
+	}
+	return cfg.RollbackCount
+}
+
+// KillSig returns signal killing the app, KillSig of the server set takes
+// precedence over the one of App.
+func (s *Server) KillSig() string {
+	return firstNonEmpty(s.serverSet().KillSig, cfg.App.KillSig)
+}
+
+// sshArgs returns arguments of OpenSSH client for connecting the server,
+// except for the host name. Host is used as it is so that ssh could apply
+// the same settings in ssh config as harp.
+func (s *Server) sshArgs() []string {
+	args := []string{"ssh"}
+	switch path := sshConfigPath(); {
+	case path == "":
+		args = append(args, "-F", "/dev/null")
+	case cfg.SSHConfig != "":
+		args = append(args, "-F", path)
+	}
+	args = append(args, hostKeySSHArgs()...)
+	args = append(args, "-l", s.User, "-p", strings.TrimLeft(s.Port, ":"))
+	if s.Proxy != nil {
+		// rsync -avrP -e 'ssh -o ProxyCommand="ssh -W %h:%p bastion-dev@proxy -p port"' test.txt app@target:~/
+		// ssh expands % tokens in ProxyCommand once, so tokens of nested
+		// proxies are escaped to be expanded by their own ssh.
+		escape := strings.NewReplacer("%", "%%").Replace
+		proxy := escape(shellJoin(s.Proxy.sshArgs())) + " -W %h:%p " + escape(shellJoin([]string{s.Proxy.Host}))
+		args = append(args, "-o", "ProxyCommand="+proxy)
+	}
+	return args
+}
+
+// rsyncSSH returns the remote shell command for rsync -e.
+func (s *Server) rsyncSSH() string { return shellJoin(s.sshArgs()) }
+
 func (s *Server) exitf(format string, args ...interface{}) {
 	exitf("[%s] "+format, append([]interface{}{s}, args...)...)
 }
@@ -298,17 +479,23 @@ func (s *Server) GetHarpComposer(who string) string {
 var releaseTsOnce sync.Once
 var releaseTs string
 
+// releaseID returns the release directory name of the current deployment.
+func releaseID() string {
+	releaseTsOnce.Do(func() { releaseTs = time.Now().Format("06-01-02-15:04:05") })
+	return releaseTs
+}
+
 func (s *Server) saveReleaseScript() (script string) {
-	if cfg.NoRollback {
+	if s.noRollback() {
 		return
 	}
 
-	releaseTsOnce.Do(func() { releaseTs = time.Now().Format("06-01-02-15:04:05") })
+	releaseID()
 
 	script += fmt.Sprintf(`cd %s/harp/%s
 if [[ -f harp-build.info ]]; then
 	mkdir -p releases/%s
-	cp -rf %s harp-build.info files kill.sh restart.sh rollback.sh releases/%s
+	cp -rf %s harp-build.info files env kill.sh restart.sh rollback.sh releases/%s
 fi`, s.Home, cfg.App.Name, releaseTs, cfg.App.Name, releaseTs)
 	return
 }
@@ -390,7 +577,7 @@ func (s *Server) retrieveRollbackScript() string {
 		s.exitf(err.Error())
 	}
 	if option.debug {
-		fmt.Println(buf.String())
+		fmt.Println(redact(buf.String()))
 	}
 	return buf.String()
 }
@@ -420,70 +607,21 @@ func (s Server) retrieveRestartScript(who string) string {
 	return buf.String()
 }
 
+// initPathes connects the server, creates harp directory and retrieves
+// paths of the server, once. It's done on demand (e.g. opening sessions),
+// so that servers are connected within limits of -parallel.
 func (s *Server) initPathes() {
-	if s.Home == "" {
-		session := s.getSession()
-		output, err := session.CombinedOutput("echo $HOME")
-		if err != nil {
-			fmt.Printf("echo $HOME on %s error: %s\n", s, err)
-		}
-		session.Close()
-		s.Home = strings.TrimSpace(string(output))
-	}
-	if s.Home == "" {
-		session := s.getSession()
-		output, err := session.CombinedOutput("pwd")
-		if err != nil {
-			fmt.Printf("pwd on %s error: %s\n", s, err)
-		}
-		session.Close()
-		s.Home = strings.TrimSpace(string(output))
-	}
-
-	if s.GoPath == "" {
-		session := s.getSession()
-		output, err := session.CombinedOutput("echo $GOPATH")
-		if err != nil {
-			fmt.Printf("echo $GOPATH on %s error: %s\n", s, err)
-		}
-		session.Close()
-		s.GoPath = strings.TrimSpace(string(output))
+	mutex := s.setUpMutex()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s.setUp {
+		return
 	}
-	if s.GoPath == "" {
+	s.initSetUp()
+	if s.GoPath == "" && s.GetAppDir() == "" {
 		s.GoPath = s.Home
 	}
-}
-
-func (s *Server) getSession() *ssh.Session {
-	if s.client == nil {
-		s.initClient()
-	}
-
-	session, err := s.client.NewSession()
-	if err != nil {
-		s.exitf("failed to get session to server %s@%s:%s: %s", s.User, s.Host, s.Port, err)
-	}
-
-	return session
-}
-
-func (s *Server) exec(cmd string) string {
-	if s.client == nil {
-		s.initClient()
-	}
-
-	session, err := s.client.NewSession()
-	if err != nil {
-		// fmt.Printf("%s: %s\n", s, err)
-		return err.Error()
-	}
-
-	output, err := session.CombinedOutput(cmd)
-	if err != nil {
-		output = append([]byte(err.Error()+"\n"), output...)
-	}
-	session.Close()
-	return string(output)
+	s.setUp = true
 }
 
 // name@host:port
@@ -491,72 +629,42 @@ func (s Server) String() string {
 	return fmt.Sprintf("%s@%s%s", s.User, s.Host, s.Port)
 }
 
-// TODO: add tests
-func (s *Server) initClient() {
-	user := s.User
-	if s.Proxy != nil {
-		user = s.Proxy.User
-	}
-
-	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+// initSetUp creates harp directory and retrieves paths of the server in one
+// session, which saves round trips of initPathes.
+func (s *Server) initSetUp() {
+	session, err := s.clientSession(commandTimeout())
 	if err != nil {
-		s.exitf("failed to dial unix SSH_AUTH_SOCK: %s", err)
+		s.exitf("failed to get session to server %s: %s", s, err)
 	}
-	signers, err := agent.NewClient(sock).Signers()
+	defer session.Close()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	cmd := fmt.Sprintf("mkdir -p harp/%s/files\necho \"HARP_HOME=$HOME\"\necho \"HARP_PWD=$(pwd)\"\necho \"HARP_GOPATH=$GOPATH\"", cfg.App.Name)
+	output, err := session.Output(cmd)
 	if err != nil {
-		s.exitf("failed to retrieve signers: %s", err)
+		s.exitf("failed to exec %s: %s %s", cmd, stderr.String(), err)
 	}
-	auths := []ssh.AuthMethod{ssh.PublicKeys(signers...)}
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: auths,
-	}
-
-	dst := s.Host + s.Port
-	if s.Proxy != nil {
-		dst = s.Proxy.Host + s.Proxy.Port
-	}
-	s.client, err = ssh.Dial("tcp", dst, config)
-	if err != nil {
-		serv := s
-		if s.Proxy != nil {
-			serv = s.Proxy
-		}
-		fmt.Fprintf(os.Stderr, "failed to dial %s: %s\n\n", serv, err)
-		fmt.Println("Harp is using ssh-agent and passwordless-login to access your servers.")
-		fmt.Println("Make sure you have added your private key in ssh-agent (ssh-add -l).")
-		fmt.Println("More information could be found here: https://github.com/bom-d-van/harp#server-access-using-ssh")
-
-		if option.debug {
-			debug.PrintStack()
-		}
-		os.Exit(1)
-	}
-
-	if s.Proxy == nil {
-		return
+	home, gopath := parseSetUp(string(output))
+	if s.Home == "" {
+		s.Home = home
 	}
-
-	bastionConn, err := s.client.Dial("tcp", s.Host+s.Port)
-	if err != nil {
-		s.exitf("failed to dial %s from bastion host %s: %s", s, s.Proxy, err)
+	if s.GoPath == "" && s.GetAppDir() == "" {
+		s.GoPath = gopath
 	}
-
-	conn, newChan, reqs, err := ssh.NewClientConn(bastionConn, s.Host+s.Port, &ssh.ClientConfig{
-		User: s.User,
-		Auth: auths,
-	})
-	if err != nil {
-		s.exitf("Failed to handshake server %s from server %s: %s", s, s.Proxy, err)
-	}
-	s.client = ssh.NewClient(conn, newChan, reqs)
 }
 
-func (s *Server) initSetUp() {
-	if s.client == nil {
-		s.initClient()
+// parseSetUp parses outputs of initSetUp. Paths are printed in tagged lines,
+// so that outputs of rc files on the server (e.g. banners) are ignored.
+func parseSetUp(output string) (home, gopath string) {
+	vals := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		for _, key := range []string{"HARP_HOME=", "HARP_PWD=", "HARP_GOPATH="} {
+			if i := strings.Index(line, key); i >= 0 {
+				vals[key] = strings.TrimSpace(line[i+len(key):])
+			}
+		}
 	}
-	runCmd(s.client, fmt.Sprintf("mkdir -p harp/%s/files", cfg.App.Name))
+	return firstNonEmpty(vals["HARP_HOME="], vals["HARP_PWD="]), vals["HARP_GOPATH="]
 }
 
 // TODO: add test
@@ -604,6 +712,65 @@ func (s *Server) prompt() string {
 	return fmt.Sprintf("%s@%s:%s$", whoami, hostname, s.Home)
 }
 
+// GetAppDir returns the directory the application is installed in when
+// AppDir is configured on the server or the app. Relative paths are resolved
+// against server's home directory. An empty string means harp is using the
+// default $GOPATH layout.
+func (s *Server) GetAppDir() string {
+	dir := s.AppDir
+	if dir == "" {
+		dir = cfg.App.AppDir
+	}
+	if dir == "" {
+		return ""
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "~" {
+		return s.Home
+	}
+	if strings.HasPrefix(dir, "~/") {
+		return s.Home + dir[1:]
+	}
+	if !strings.HasPrefix(dir, "/") {
+		return s.Home + "/" + dir
+	}
+	return dir
+}
+
+// AppRoot returns the working directory of the application, where
+// harp-build.info and files of the application are saved.
+//
+// Default: $GOPATH/src/$ImportPath/
 func (s *Server) AppRoot() string {
+	if dir := s.GetAppDir(); dir != "" {
+		return dir + "/"
+	}
 	return fmt.Sprintf("%s/src/%s/", s.GoPath, cfg.App.ImportPath)
 }
+
+// BinPath returns the path of the installed application binary.
+//
+// Default: $GOPATH/bin/$App
+func (s *Server) BinPath() string {
+	if dir := s.GetAppDir(); dir != "" {
+		return fmt.Sprintf("%s/bin/%s", dir, cfg.App.Name)
+	}
+	return fmt.Sprintf("%s/bin/%s", s.GoPath, cfg.App.Name)
+}
+
+// FilePath returns the server location of path specified in App.Files.
+// Under AppDir, paths inside of App.ImportPath are saved relatively to
+// AppDir, and the others keep their full import path.
+func (s *Server) FilePath(path string) string {
+	dir := s.GetAppDir()
+	if dir == "" {
+		return fmt.Sprintf("%s/src/%s", s.GoPath, path)
+	}
+	if path == cfg.App.ImportPath {
+		return dir
+	}
+	if rel := strings.TrimPrefix(path, cfg.App.ImportPath+"/"); rel != path {
+		return dir + "/" + rel
+	}
+	return dir + "/" + path
+}
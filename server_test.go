@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAppPaths(t *testing.T) {
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.App.Name = "app"
+	cfg.App.ImportPath = "github.com/bom-d-van/app"
+
+	for _, c := range []struct {
+		appDir, serverAppDir string
+		appDirWant           string
+		root, bin            string
+		files                map[string]string
+	}{
+		{
+			appDirWant: "",
+			root:       "/go/src/github.com/bom-d-van/app/",
+			bin:        "/go/bin/app",
+			files: map[string]string{
+				"github.com/bom-d-van/app":        "/go/src/github.com/bom-d-van/app",
+				"github.com/bom-d-van/app/config": "/go/src/github.com/bom-d-van/app/config",
+				"github.com/bom-d-van/lib/tmpl":   "/go/src/github.com/bom-d-van/lib/tmpl",
+			},
+		},
+		{
+			appDir:     "/opt/app/",
+			appDirWant: "/opt/app",
+			root:       "/opt/app/",
+			bin:        "/opt/app/bin/app",
+			files: map[string]string{
+				"github.com/bom-d-van/app":         "/opt/app",
+				"github.com/bom-d-van/app/config":  "/opt/app/config",
+				"github.com/bom-d-van/application": "/opt/app/github.com/bom-d-van/application",
+				"github.com/bom-d-van/lib/tmpl":    "/opt/app/github.com/bom-d-van/lib/tmpl",
+			},
+		},
+		{appDir: "apps/app", appDirWant: "/home/app/apps/app", root: "/home/app/apps/app/", bin: "/home/app/apps/app/bin/app"},
+		{appDir: "~/apps/app", appDirWant: "/home/app/apps/app", root: "/home/app/apps/app/", bin: "/home/app/apps/app/bin/app"},
+		{appDir: "~", appDirWant: "/home/app", root: "/home/app/", bin: "/home/app/bin/app"},
+		{appDir: "/opt/app", serverAppDir: "srv", appDirWant: "/home/app/srv", root: "/home/app/srv/", bin: "/home/app/srv/bin/app"},
+	} {
+		cfg.App.AppDir = c.appDir
+		s := &Server{Home: "/home/app", GoPath: "/go", AppDir: c.serverAppDir}
+		if got := s.GetAppDir(); got != c.appDirWant {
+			t.Errorf("AppDir %q/%q: GetAppDir() = %q; want %q", c.appDir, c.serverAppDir, got, c.appDirWant)
+		}
+		if got := s.AppRoot(); got != c.root {
+			t.Errorf("AppDir %q/%q: AppRoot() = %q; want %q", c.appDir, c.serverAppDir, got, c.root)
+		}
+		if got := s.BinPath(); got != c.bin {
+			t.Errorf("AppDir %q/%q: BinPath() = %q; want %q", c.appDir, c.serverAppDir, got, c.bin)
+		}
+		for path, want := range c.files {
+			if got := s.FilePath(path); got != want {
+				t.Errorf("AppDir %q: FilePath(%q) = %q; want %q", c.appDir, path, got, want)
+			}
+		}
+	}
+}
+
+func TestNewOneShotServer(t *testing.T) {
+	conf, err := parseSSHConfig(strings.NewReader(`
+Host prod-db prod-web-*
+	User app
+`), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConf := userSSHConfig
+	defer func() { userSSHConfig = oldConf }()
+	sshConfigOnce.Do(func() {})
+	userSSHConfig = conf
+
+	for url, want := range map[string]string{
+		"app@web-01:2222": "app@web-01:2222",
+		"app@web-01":      "app@web-01",
+		"web-01:2222":     "@web-01:2222",
+		"10.0.0.1":        "@10.0.0.1",
+		"web.example.com": "@web.example.com",
+		"localhost":       "@localhost",
+		"prod-db":         "@prod-db",
+		// mistyped IDs or hosts only matched by wildcards
+		"web-01":     "",
+		"prod-web-1": "",
+	} {
+		var got string
+		if s := newOneShotServer(url); s != nil {
+			got = s.User + "@" + s.Host + s.Port
+		}
+		if got != want {
+			t.Errorf("newOneShotServer(%q) = %q; want %q", url, got, want)
+		}
+	}
+}
+
+func TestParseSetUp(t *testing.T) {
+	for output, want := range map[string][2]string{
+		"HARP_HOME=/home/app\nHARP_PWD=/home/app\nHARP_GOPATH=/go\n":                   {"/home/app", "/go"},
+		"Welcome!\n\nHARP_HOME=/home/app\nHARP_PWD=/tmp\nHARP_GOPATH=\nbye\n":          {"/home/app", ""},
+		"Last login: today HARP_HOME=\nHARP_PWD=/home/app\nHARP_GOPATH=/home/app/go\n": {"/home/app", "/home/app/go"},
+		"": {"", ""},
+	} {
+		if home, gopath := parseSetUp(output); home != want[0] || gopath != want[1] {
+			t.Errorf("parseSetUp(%q) = %q, %q; want %q, %q", output, home, gopath, want[0], want[1])
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sshConfig is a subset of OpenSSH client config (ssh_config(5)). Only Host
+// blocks are supported, Match blocks are skipped.
+type sshConfig struct {
+	blocks []sshConfigBlock
+}
+
+type sshConfigBlock struct {
+	patterns []string
+	options  []sshConfigOption
+}
+
+type sshConfigOption struct {
+	key  string // lower case
+	args []string
+}
+
+// parseSSHConfig parses ssh config. Options before the first Host block are
+// applied to all hosts. Include is supported, with path relative to dir.
+func parseSSHConfig(r io.Reader, dir string, depth int) (*sshConfig, error) {
+	if depth > 16 {
+		return nil, fmt.Errorf("too many nested includes")
+	}
+
+	var conf sshConfig
+	block := &sshConfigBlock{patterns: []string{"*"}}
+	scanner := bufio.NewScanner(r)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		key, args, err := splitSSHConfigLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+
+		switch key {
+		case "host":
+			conf.blocks = append(conf.blocks, *block)
+			block = &sshConfigBlock{patterns: args}
+		case "match":
+			conf.blocks = append(conf.blocks, *block)
+			block = &sshConfigBlock{}
+		case "include":
+			conf.blocks = append(conf.blocks, *block)
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				paths, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s", lineNum, err)
+				}
+				for _, path := range paths {
+					included, err := parseSSHConfigFile(path, dir, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					for i, b := range included.blocks {
+						// leading options of included file belong to the current block
+						if i == 0 {
+							b.patterns = block.patterns
+						}
+						conf.blocks = append(conf.blocks, b)
+					}
+				}
+			}
+			block = &sshConfigBlock{patterns: block.patterns}
+		default:
+			block.options = append(block.options, sshConfigOption{key: key, args: args})
+		}
+	}
+	conf.blocks = append(conf.blocks, *block)
+
+	return &conf, scanner.Err()
+}
+
+func parseSSHConfigFile(path, dir string, depth int) (*sshConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	conf, err := parseSSHConfig(file, dir, depth)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return conf, nil
+}
+
+// splitSSHConfigLine splits "Key value" or "Key=value" into lower-cased key
+// and arguments. Double-quoted arguments could contain spaces.
+func splitSSHConfigLine(line string) (key string, args []string, err error) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return "", nil, fmt.Errorf("missing argument: %s", line)
+	}
+	key = strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote: %s", line)
+			}
+			arg, rest = rest[1:end+1], rest[end+2:]
+		} else if end := strings.IndexAny(rest, " \t"); end >= 0 {
+			arg, rest = rest[:end], rest[end:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing argument: %s", line)
+	}
+	return
+}
+
+// matches reports whether host matches patterns of the block. A negated
+// pattern (!pattern) prevents the block from matching.
+func (b sshConfigBlock) matches(host string) bool {
+	var matched bool
+	for _, pattern := range b.patterns {
+		for _, p := range strings.Split(pattern, ",") {
+			if strings.HasPrefix(p, "!") {
+				if matchSSHPattern(p[1:], host) {
+					return false
+				}
+				continue
+			}
+			if matchSSHPattern(p, host) {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// hasAlias reports whether host is named in a Host line of the config, rather
+// than only matched by wildcards.
+func (c *sshConfig) hasAlias(host string) bool {
+	if c == nil {
+		return false
+	}
+	for _, b := range c.blocks {
+		for _, pattern := range b.patterns {
+			for _, p := range strings.Split(pattern, ",") {
+				if !strings.ContainsAny(p, "*?!") && strings.EqualFold(p, host) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchSSHPattern matches str against pattern with wildcards * and ?.
+func matchSSHPattern(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(str); i >= 0; i-- {
+				if matchSSHPattern(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+		default:
+			if len(str) == 0 || !strings.EqualFold(pattern[:1], str[:1]) {
+				return false
+			}
+		}
+		pattern, str = pattern[1:], str[1:]
+	}
+	return len(str) == 0
+}
+
+// get returns the first obtained value of key for host, as OpenSSH does.
+func (c *sshConfig) get(host, key string) string {
+	if c == nil {
+		return ""
+	}
+	for _, b := range c.blocks {
+		if !b.matches(host) {
+			continue
+		}
+		for _, o := range b.options {
+			if o.key == key {
+				return o.args[0]
+			}
+		}
+	}
+	return ""
+}
+
+// getAll returns all the values of key for host, for options like
+// IdentityFile that could be specified multiple times.
+func (c *sshConfig) getAll(host, key string) (vals []string) {
+	if c == nil {
+		return
+	}
+	for _, b := range c.blocks {
+		if !b.matches(host) {
+			continue
+		}
+		for _, o := range b.options {
+			if o.key == key {
+				vals = append(vals, o.args...)
+			}
+		}
+	}
+	return
+}
+
+var sshConfigOnce sync.Once
+var userSSHConfig *sshConfig
+
+// sshConfigPath returns the ssh config file harp reads, which could be
+// specified by SSHConfig in harp.json. "none" disables ssh config.
+func sshConfigPath() string {
+	switch cfg.SSHConfig {
+	case "none":
+		return ""
+	case "":
+		return expandHome("~/.ssh/config")
+	}
+	return expandHome(cfg.SSHConfig)
+}
+
+func loadSSHConfig() *sshConfig {
+	sshConfigOnce.Do(func() {
+		path := sshConfigPath()
+		if path == "" {
+			return
+		}
+		conf, err := parseSSHConfigFile(path, expandHome("~/.ssh"), 0)
+		if os.IsNotExist(err) && cfg.SSHConfig == "" {
+			return
+		} else if err != nil {
+			exitf("failed to load ssh config: %s", err)
+		}
+		userSSHConfig = conf
+	})
+	return userSSHConfig
+}
+
+// resolve fills up server settings from ssh config and defaults. Settings
+// specified in harp.json take precedence. Proxy servers are resolved too.
+func (s *Server) resolve() {
+	if s.resolved {
+		return
+	}
+	s.resolved = true
+
+	conf := loadSSHConfig()
+	alias := s.Host
+	if hostname := conf.get(alias, "hostname"); hostname != "" {
+		s.hostname = strings.Replace(hostname, "%h", alias, -1)
+	}
+	if s.User == "" {
+		s.User = conf.get(alias, "user")
+	}
+	if s.User == "" {
+		s.User = currentUser()
+	}
+	if s.Port == "" {
+		if port := conf.get(alias, "port"); port != "" {
+			s.Port = ":" + port
+		}
+	}
+	if s.Port == "" {
+		s.Port = ":22"
+	}
+	for _, file := range conf.getAll(alias, "identityfile") {
+		if strings.EqualFold(file, "none") {
+			continue
+		}
+		file = strings.NewReplacer("%d", homeDir(), "%u", currentUser(), "%r", s.User, "%h", s.hostAddr()).Replace(file)
+		s.identityFiles = append(s.identityFiles, expandHome(file))
+	}
+	if interval := conf.get(alias, "serveraliveinterval"); interval != "" {
+		secs, err := strconv.Atoi(interval)
+		if err != nil {
+			s.exitf("bad ServerAliveInterval in ssh config: %s", interval)
+		}
+		s.aliveInterval = time.Duration(secs) * time.Second
+	}
+	if s.Proxy == nil && s.hops == 0 {
+		s.Proxy = s.serverSet().Proxy
+	}
+	if jump := conf.get(alias, "proxyjump"); s.Proxy == nil && jump != "" && jump != "none" {
+		// hops are connected from left to right
+		for _, hop := range strings.Split(jump, ",") {
+			proxy := newJumpHost(hop)
+			proxy.Proxy = s.Proxy
+			s.Proxy = proxy
+		}
+	}
+
+	if s.Proxy != nil {
+		if s.Proxy.hops = s.hops + 1; s.Proxy.hops > 8 {
+			s.exitf("too many proxies, is there a loop in ProxyJump of ssh config?")
+		}
+		if s.Proxy.Set == "" {
+			s.Proxy.Set = s.Set
+		}
+		s.Proxy.resolve()
+		s.Proxy = sharedProxy(s.Proxy)
+	}
+}
+
+var sharedProxies = struct {
+	sync.Mutex
+	m map[string]*Server
+}{m: map[string]*Server{}}
+
+// sharedProxy returns the first proxy with the same chain, so that servers
+// behind the same bastion hosts share connections.
+func sharedProxy(proxy *Server) *Server {
+	var chain []string
+	for p := proxy; p != nil; p = p.Proxy {
+		chain = append(chain, p.User+"@"+p.addr())
+	}
+	key := strings.Join(chain, " via ")
+
+	sharedProxies.Lock()
+	defer sharedProxies.Unlock()
+	if shared := sharedProxies.m[key]; shared != nil {
+		return shared
+	}
+	sharedProxies.m[key] = proxy
+	return proxy
+}
+
+// newJumpHost parses ProxyJump host in form of [user@]host[:port].
+func newJumpHost(str string) *Server {
+	var s Server
+	if i := strings.LastIndex(str, "@"); i >= 0 {
+		s.User, str = str[:i], str[i+1:]
+	}
+	if i := strings.LastIndex(str, ":"); i >= 0 {
+		s.Port, str = str[i:], str[:i]
+	}
+	s.Host = str
+	return &s
+}
+
+// hostAddr returns the real host name of server, which is HostName in ssh
+// config or Host.
+func (s *Server) hostAddr() string {
+	if s.hostname != "" {
+		return s.hostname
+	}
+	return s.Host
+}
+
+// addr returns host:port for dialing.
+func (s *Server) addr() string { return s.hostAddr() + s.Port }
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir
+	}
+	return ""
+}
+
+// expandHome replaces leading ~ in local path with home directory.
+func expandHome(path string) string {
+	if path == "~" {
+		return homeDir()
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(homeDir(), path[2:])
+	}
+	return path
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSSHConfig(t *testing.T) {
+	conf, err := parseSSHConfig(strings.NewReader(`
+# global options
+ServerAliveInterval 30
+
+Host prod-web-* !prod-web-9
+	HostName %h.example.com
+	User deploy
+	Port=2222
+	IdentityFile ~/.ssh/prod
+	ProxyJump bastion@jump.example.com:2200
+
+Host prod-web-9
+	User "web user"
+
+Host *
+	User nobody
+	IdentityFile ~/.ssh/id_rsa
+`), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		host, key, want string
+	}{
+		{"prod-web-1", "hostname", "%h.example.com"},
+		{"prod-web-1", "user", "deploy"},
+		{"prod-web-1", "port", "2222"},
+		{"prod-web-1", "proxyjump", "bastion@jump.example.com:2200"},
+		{"prod-web-1", "serveraliveinterval", "30"},
+		{"prod-web-9", "user", "web user"},
+		{"prod-web-9", "port", ""},
+		{"PROD-WEB-2", "user", "deploy"},
+		{"other", "user", "nobody"},
+	} {
+		if got := conf.get(c.host, c.key); got != c.want {
+			t.Errorf("%s %s: expect %q got %q", c.host, c.key, c.want, got)
+		}
+	}
+
+	if got, want := conf.getAll("prod-web-1", "identityfile"), []string{"~/.ssh/prod", "~/.ssh/id_rsa"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expect %q got %q", want, got)
+	}
+}
+
+func TestNewJumpHost(t *testing.T) {
+	s := newJumpHost("bastion@jump.example.com:2200")
+	if s.User != "bastion" || s.Host != "jump.example.com" || s.Port != ":2200" {
+		t.Errorf("unexpected jump host: %+v", s)
+	}
+	s = newJumpHost("jump")
+	if s.User != "" || s.Host != "jump" || s.Port != "" {
+		t.Errorf("unexpected jump host: %+v", s)
+	}
+}
+
+func TestResolveProxyChain(t *testing.T) {
+	conf, err := parseSSHConfig(strings.NewReader(`
+Host target
+	User app
+	ProxyJump jump1,ops@jump2:2200
+`), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCfg, oldConf := cfg, userSSHConfig
+	defer func() { cfg, userSSHConfig = oldCfg, oldConf }()
+	defer removeRuntimeDir()
+	sshConfigOnce.Do(func() {})
+	userSSHConfig = conf
+	cfg.SSHConfig = "none"
+	cfg.HostKeyCheck = hostKeyOff
+
+	s := &Server{Host: "target"}
+	s.resolve()
+	if s.Proxy == nil || s.Proxy.String() != "ops@jump2:2200" {
+		t.Fatalf("unexpected proxy: %v", s.Proxy)
+	}
+	if s.Proxy.Proxy == nil || s.Proxy.Proxy.Host != "jump1" || s.Proxy.Proxy.Port != ":22" {
+		t.Fatalf("unexpected proxy of proxy: %v", s.Proxy.Proxy)
+	}
+
+	args := s.sshArgs()
+	got := args[len(args)-1]
+	want := `ProxyCommand=ssh -F /dev/null -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -l ops -p 2200 -o ` +
+		`'ProxyCommand=ssh -F /dev/null -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -l ` + currentUser() + ` -p 22 -W %%h:%%p jump1'` +
+		` -W %h:%p jump2`
+	if got != want {
+		t.Errorf("ProxyCommand:\n got %s\nwant %s", got, want)
+	}
+
+	other := &Server{Host: "target", User: "other"}
+	other.resolve()
+	if other.Proxy != s.Proxy {
+		t.Error("proxy isn't shared by servers behind it")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// statusScriptTmpl prints process status of the application in key=value
+// lines. It's linux specific (procfs), but still reports whether the process
+// is alive on other systems. bin is the canonical path of the binary, as the
+// one of /proc/$pid/exe, in case of symlinks in $HOME or AppDir.
+var statusScriptTmpl = template.Must(template.New("").Parse(`if [[ ! -f {{.PIDPath}} ]]; then
+	echo "state=no pid file"
+	exit 0
+fi
+pid=$(cat {{.PIDPath}})
+echo "pid=$pid"
+if [[ -f {{.HistoryLogPath}} ]]; then
+	echo "last=$(grep -E '"type": "(deploy|restart|rollback)"' {{.HistoryLogPath}} | tail -n 1)"
+fi
+if ! ps -p $pid > /dev/null 2>&1; then
+	echo "state=stopped"
+	exit 0
+fi
+echo "state=running"
+echo "comm=$(ps -o comm= -p $pid)"
+echo "exe=$(readlink /proc/$pid/exe 2>/dev/null)"
+echo "bin=$(readlink -f {{.BinPath}} 2>/dev/null)"
+echo "etimes=$(ps -o etimes= -p $pid | tr -d ' ')"
+echo "rss=$(ps -o rss= -p $pid | tr -d ' ')"
+echo "cpu=$(ps -o %cpu= -p $pid | tr -d ' ')"
+echo "fds=$(ls /proc/$pid/fd 2>/dev/null | wc -l | tr -d ' ')"
+if command -v ss > /dev/null 2>&1; then
+	ports=$(ss -ltnpH 2>/dev/null | grep "pid=$pid," | awk '{print $4}')
+else
+	ports=$(netstat -ltnp 2>/dev/null | awk -v p="$pid/" 'index($7, p) == 1 {print $4}')
+fi
+echo "ports="$ports`))
+
+type processStatus struct {
+	State   string
+	PID     string
+	Exe     string
+	Uptime  time.Duration
+	RSS     int64 // bytes
+	CPU     string
+	FDs     string
+	Ports   []string
+	Last    string // last deploy/restart/rollback entry in history.log
+	Warning string
+}
+
+func (s *Server) retrieveStatusScript() string {
+	s.initPathes()
+	var buf bytes.Buffer
+	if err := statusScriptTmpl.Execute(&buf, s); err != nil {
+		s.exitf("failed to execute statusScriptTmpl: %s", err)
+	}
+	return buf.String()
+}
+
+func (s *Server) getStatus() (st processStatus, err error) {
+	session := s.getSession()
+	defer session.Close()
+	output, err := session.CombinedOutput(s.retrieveStatusScript())
+	if err != nil {
+		return st, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return s.parseStatus(string(output)), nil
+}
+
+func (s *Server) parseStatus(output string) (st processStatus) {
+	var comm, bin string
+	for _, line := range strings.Split(output, "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "state":
+			st.State = val
+		case "pid":
+			st.PID = val
+		case "comm":
+			comm = val
+		case "exe":
+			st.Exe = val
+		case "bin":
+			bin = val
+		case "etimes":
+			if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+				st.Uptime = time.Duration(secs) * time.Second
+			}
+		case "rss":
+			if kb, err := strconv.ParseInt(val, 10, 64); err == nil {
+				st.RSS = kb << 10
+			}
+		case "cpu":
+			st.CPU = val
+		case "fds":
+			st.FDs = val
+		case "ports":
+			st.Ports = strings.Fields(val)
+		case "last":
+			st.Last = strings.TrimSpace(strings.TrimPrefix(val, "[harp]"))
+		}
+	}
+
+	if st.State != "running" {
+		return
+	}
+
+	// make sure the pid isn't reused by other processes
+	bin = firstNonEmpty(bin, s.BinPath())
+	switch {
+	case st.Exe == bin:
+	case st.Exe == bin+" (deleted)":
+		st.Warning = "binary is replaced since started, restart to run the current release"
+	case st.Exe != "":
+		st.State = "stopped"
+		st.Warning = fmt.Sprintf("pid %s is %s, not %s", st.PID, st.Exe, bin)
+	case comm != "" && !strings.HasPrefix(cfg.App.Name, comm):
+		// comm is truncated to 15 bytes
+		st.State = "stopped"
+		st.Warning = fmt.Sprintf("pid %s is %s, not %s", st.PID, comm, cfg.App.Name)
+	}
+
+	return
+}
+
+func fmtUptime(d time.Duration) string {
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%dd%s", d/(24*time.Hour), d%(24*time.Hour))
+	}
+	return d.String()
+}
+
+func status(servers []*Server) {
+	type result struct {
+		server *Server
+		status processStatus
+		err    error
+	}
+	results := make([]result, len(servers))
+	eachServer(servers, func(i int, serv *Server) {
+		results[i].server = serv
+		results[i].status, results[i].err = serv.getStatus()
+	})
+
+	var failed bool
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SET\tSERVER\tSTATE\tPID\tUPTIME\tCPU\tRSS\tFDS\tPORTS\tLAST RESTART")
+	for _, r := range results {
+		if r.err != nil {
+			failed = true
+			fmt.Fprintf(w, "%s\t%s\terror: %s\n", r.server.Set, r.server, r.err)
+			continue
+		}
+		st := r.status
+		if st.State != "running" {
+			failed = true
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\t\t\t\t\t%s\n", r.server.Set, r.server, st.State, st.PID, st.Last)
+			continue
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s%%\t%s\t%s\t%s\t%s\n",
+			r.server.Set, r.server, st.State, st.PID,
+			fmtUptime(st.Uptime), st.CPU, fmtFileSize(st.RSS), st.FDs,
+			strings.Join(st.Ports, ","), st.Last,
+		)
+	}
+	w.Flush()
+
+	for _, r := range results {
+		if r.status.Warning != "" {
+			fmt.Printf("[%s] %s: %s\n", r.server.Set, r.server, r.status.Warning)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
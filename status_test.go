@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStatus(t *testing.T) {
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.App.Name = "app-server-with-long-name"
+	s := &Server{AppDir: "/opt/app"}
+
+	running := "pid=42\nlast=[harp] {\"type\": \"deploy\"}\nstate=running\netimes=90061\nrss=2048\ncpu=1.5\nfds=12\nports=0.0.0.0:80 [::]:443\n"
+	got := s.parseStatus(running + "comm=app-server-wit\nexe=/opt/app/bin/app-server-with-long-name\n")
+	want := processStatus{
+		State:  "running",
+		PID:    "42",
+		Exe:    "/opt/app/bin/app-server-with-long-name",
+		Uptime: 90061 * time.Second,
+		RSS:    2 << 20,
+		CPU:    "1.5",
+		FDs:    "12",
+		Ports:  []string{"0.0.0.0:80", "[::]:443"},
+		Last:   `{"type": "deploy"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStatus = %+v; want %+v", got, want)
+	}
+
+	for _, c := range []struct {
+		output, state string
+		warned        bool
+	}{
+		{"state=no pid file\n", "no pid file", false},
+		{"pid=42\nstate=stopped\n", "stopped", false},
+		{running + "exe=/opt/app/bin/app-server-with-long-name (deleted)\n", "running", true},
+		{running + "comm=nginx\nexe=/usr/sbin/nginx\n", "stopped", true},
+		// no /proc: fallback to comm, which is truncated to 15 bytes
+		{running + "comm=app-server-wit\nexe=\n", "running", false},
+		{running + "comm=nginx\nexe=\n", "stopped", true},
+		{running + "exe=\n", "running", false},
+		// AppDir through symlinks, bin is canonicalized on the server
+		{running + "exe=/srv/app/bin/app-server-with-long-name\nbin=/srv/app/bin/app-server-with-long-name\n", "running", false},
+		{running + "exe=/srv/app/bin/app-server-with-long-name (deleted)\nbin=/srv/app/bin/app-server-with-long-name\n", "running", true},
+		{running + "exe=/srv/app/bin/app-server-with-long-name\nbin=\n", "stopped", true},
+	} {
+		st := s.parseStatus(c.output)
+		if st.State != c.state || (st.Warning != "") != c.warned {
+			t.Errorf("parseStatus(%q) = %q, warning %q; want %q, warned %t", c.output, st.State, st.Warning, c.state, c.warned)
+		}
+	}
+}
+
+func TestFmtUptime(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                                        "0s",
+		90 * time.Second:                         "1m30s",
+		23*time.Hour + 59*time.Minute:            "23h59m0s",
+		24 * time.Hour:                           "1d0s",
+		50*time.Hour + time.Minute + time.Second: "2d2h1m1s",
+	} {
+		if got := fmtUptime(d); got != want {
+			t.Errorf("fmtUptime(%s) = %q; want %q", d, got, want)
+		}
+	}
+}
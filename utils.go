@@ -5,9 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
-
-	"golang.org/x/crypto/ssh"
 )
 
 func writeToTar(tarw *tar.Writer, name string, file io.Reader, fi os.FileInfo) {
@@ -46,17 +45,62 @@ func writeInfoToTar(tarw *tar.Writer, info string) {
 	}
 }
 
-func runCmd(sshc *ssh.Client, cmd string) (output []byte) {
-	session, err := sshc.NewSession()
-	if err != nil {
-		exitf("failed to create session: %s", err)
-	}
-	defer session.Close()
+// shellQuote quotes str by single quotes for sh.
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
 
-	output, err = session.CombinedOutput(cmd)
-	if err != nil {
-		exitf("failed to exec %s: %s %s", cmd, string(output), err)
+// shellJoin joins args into a command line for sh, quoting args when necessary.
+func shellJoin(args []string) string {
+	var quoted []string
+	for _, arg := range args {
+		if arg == "" || strings.IndexFunc(arg, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:@%,=+", r))
+		}) >= 0 {
+			arg = shellQuote(arg)
+		}
+		quoted = append(quoted, arg)
 	}
+	return strings.Join(quoted, " ")
+}
 
-	return
+// shellSplit splits a command line into args like sh, supporting single
+// quotes, double quotes and backslashes, but not expansions.
+func shellSplit(line string) ([]string, error) {
+	var args []string
+	var arg []rune
+	var inArg, escaped bool
+	var quote rune
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg = append(arg, r)
+			escaped = false
+		case quote == '\'' && r == '\'', quote == '"' && r == '"':
+			quote = 0
+		case quote == '\'':
+			arg = append(arg, r)
+		case r == '\\':
+			escaped, inArg = true, true
+		case quote == '"':
+			arg = append(arg, r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+		default:
+			arg = append(arg, r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", line)
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
 }
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// configIssue is a problem found by harp validate, located in a config file
+// if possible.
+type configIssue struct {
+	file      string
+	line, col int
+	path      string // e.g. Servers.prod.0.Host
+	msg       string
+}
+
+func (i configIssue) String() string {
+	var str string
+	switch {
+	case i.line > 0:
+		str = fmt.Sprintf("%s:%d:%d: ", i.file, i.line, i.col)
+	case i.file != "":
+		str = i.file + ": "
+	}
+	if i.path != "" {
+		str += i.path + ": "
+	}
+	return str + i.msg
+}
+
+// configFile is a config file read by harp validate, data is cleaned by
+// cleanJSON.
+type configFile struct {
+	path string
+	data []byte
+}
+
+// configFileSchema is the schema of a config file.
+type configFileSchema struct {
+	Config
+	Extends string
+	Include []string
+}
+
+func validateCmd() {
+	issues := validateConfig(option.configPaths)
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		fmt.Printf("found %d problem(s)\n", len(issues))
+		removeRuntimeDir()
+		os.Exit(1)
+	}
+	fmt.Println("config is valid")
+}
+
+// validateConfig checks syntax and keys of every config file, and settings
+// of the merged config.
+func validateConfig(paths []string) (issues []configIssue) {
+	var files []configFile
+	merged := map[string]interface{}{}
+	for _, path := range paths {
+		var broken bool
+		conf, err := readConfigTree(path, nil, func(path string, data []byte) {
+			if format := configFormat(path); format != formatJSON {
+				// keys are checked in JSON, without line numbers
+				conf, err := decodeConfig(format, data)
+				if err != nil {
+					issues = append(issues, configIssue{file: path, msg: err.Error()})
+					broken = true
+					return
+				}
+				data, _ = encodeConfig(formatJSON, conf)
+				keyIssues, _ := checkConfigKeys(path, data)
+				for _, issue := range keyIssues {
+					issue.line, issue.col = 0, 0
+					issues = append(issues, issue)
+				}
+				return
+			}
+			clean, err := cleanJSON(data)
+			if err != nil {
+				issues = append(issues, configIssue{file: path, msg: err.Error()})
+				broken = true
+				return
+			}
+			files = append(files, configFile{path: path, data: clean})
+			keyIssues, ok := checkConfigKeys(path, clean)
+			issues = append(issues, keyIssues...)
+			broken = broken || !ok
+		})
+		if err != nil {
+			// syntax errors are reported with line numbers already
+			if !broken {
+				issues = append(issues, configIssue{msg: err.Error()})
+			}
+			return
+		}
+		merged = mergeConfig(merged, conf)
+	}
+	if len(issues) > 0 {
+		// settings are not reliable with wrong keys or types
+		return
+	}
+
+	if varIssues := interpolateConfig(merged, interpolateChecks{envs: true, secrets: true}); len(varIssues) > 0 {
+		for _, issue := range varIssues {
+			issues = append(issues, locateConfigIssue(files, issue))
+		}
+		return
+	}
+
+	data, _ := json.Marshal(merged)
+	var conf Config
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return append(issues, configIssue{msg: err.Error()})
+	}
+	for _, issue := range checkConfig(conf) {
+		issues = append(issues, locateConfigIssue(files, issue))
+	}
+	return
+}
+
+var fileType = reflect.TypeOf(File{})
+
+// checkConfigKeys checks syntax, keys and value types of a config file. ok is
+// false for syntax errors.
+func checkConfigKeys(path string, data []byte) (issues []configIssue, ok bool) {
+	report := func(offset int, keyPath, msg string) {
+		line, col := lineCol(data, offset)
+		issues = append(issues, configIssue{file: path, line: line, col: col, path: keyPath, msg: msg})
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := checkJSONValue(dec, data, reflect.TypeOf(configFileSchema{}), "", report); err != nil {
+		offset := int(dec.InputOffset())
+		if serr, ok := err.(*json.SyntaxError); ok {
+			offset = int(serr.Offset)
+		}
+		report(offset, "", err.Error())
+		return issues, false
+	}
+	if rest := skipJSONSpaces(data, int(dec.InputOffset())); rest < len(data) {
+		report(rest, "", "unexpected content after the config")
+	}
+	return issues, true
+}
+
+// checkJSONValue walks the next JSON value, and reports unknown keys and
+// mismatched types against typ. A nil typ accepts anything.
+func checkJSONValue(dec *json.Decoder, data []byte, typ reflect.Type, path string, report func(offset int, path, msg string)) error {
+	start := skipJSONSpaces(data, int(dec.InputOffset()))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == fileType {
+		// string or object form
+		if _, ok := tok.(string); ok {
+			return nil
+		}
+		typ = reflect.TypeOf(file{})
+	}
+
+	mismatch := func(want string) {
+		report(start, path, fmt.Sprintf("%s expected, got %s", want, jsonKind(tok)))
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			var elem reflect.Type
+			if typ != nil {
+				if typ.Kind() == reflect.Slice {
+					elem = typ.Elem()
+				} else if typ.Kind() != reflect.Interface {
+					mismatch(typeName(typ))
+				}
+			}
+			for i := 0; dec.More(); i++ {
+				if err := checkJSONValue(dec, data, elem, joinKeyPath(path, strconv.Itoa(i)), report); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+
+		var kind reflect.Kind
+		if typ != nil {
+			kind = typ.Kind()
+			if kind != reflect.Struct && kind != reflect.Map && kind != reflect.Interface {
+				mismatch(typeName(typ))
+				typ = nil
+			}
+		}
+		for dec.More() {
+			keyStart := skipJSONSpaces(data, int(dec.InputOffset()))
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			name, _ := key.(string)
+			var elem reflect.Type
+			switch {
+			case typ == nil || kind == reflect.Interface:
+			case kind == reflect.Map:
+				elem = typ.Elem()
+			default:
+				field, ok := lookupField(typ, name)
+				if !ok {
+					msg := "unknown key"
+					if suggestion := suggestField(typ, name); suggestion != "" {
+						msg += fmt.Sprintf(", did you mean %s?", suggestion)
+					}
+					report(keyStart, joinKeyPath(path, name), msg)
+				}
+				elem = field.Type
+			}
+			if err := checkJSONValue(dec, data, elem, joinKeyPath(path, name), report); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	case nil:
+		return nil
+	}
+
+	if typ == nil {
+		return nil
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		if _, ok := tok.(string); !ok {
+			mismatch("string")
+		}
+	case reflect.Bool:
+		if _, ok := tok.(bool); !ok {
+			mismatch("boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := tok.(json.Number); !ok {
+			mismatch("integer")
+		} else if _, err := n.Int64(); err != nil {
+			mismatch("integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := tok.(json.Number); !ok {
+			mismatch("number")
+		}
+	case reflect.Interface:
+	default:
+		mismatch(typeName(typ))
+	}
+	return nil
+}
+
+func joinKeyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func jsonKind(tok json.Token) string {
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			return "list"
+		}
+		return "object"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func typeName(typ reflect.Type) string {
+	switch typ.Kind() {
+	case reflect.Slice:
+		return "list"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return typ.Kind().String()
+}
+
+// configFields returns fields of struct typ decoded by encoding/json.
+func configFields(typ reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(f.Type)...)
+			continue
+		}
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// lookupField finds field by key case-insensitively, like encoding/json.
+func lookupField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for _, f := range configFields(typ) {
+		if strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestField returns the field name closest to a misspelled key.
+func suggestField(typ reflect.Type, key string) string {
+	var suggestion string
+	best := 3 // at most 2 edits
+	for _, f := range configFields(typ) {
+		if d := editDistance(strings.ToLower(f.Name), strings.ToLower(key)); d < best {
+			best, suggestion = d, f.Name
+		}
+	}
+	return suggestion
+}
+
+// editDistance returns the optimal string alignment distance of a and b,
+// which counts transposition of adjacent characters as one edit.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(n int, ns ...int) int {
+	for _, m := range ns {
+		if m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+// checkConfig checks settings of the merged config.
+func checkConfig(conf Config) (issues []configIssue) {
+	add := func(path, format string, args ...interface{}) {
+		issues = append(issues, configIssue{path: path, msg: fmt.Sprintf(format, args...)})
+	}
+
+	if conf.App.Name == "" {
+		add("App.Name", "required")
+	}
+	if conf.App.ImportPath == "" {
+		add("App.ImportPath", "required")
+	}
+	for i, f := range conf.App.Files {
+		path := fmt.Sprintf("App.Files.%d", i)
+		if f.Path == "" {
+			add(path, "Path is required")
+			continue
+		}
+		if findGoPathFile(f.Path) == "" {
+			add(path, "%s is not found in GOPATH (%s)", f.Path, strings.Join(GoPaths, ":"))
+		}
+	}
+
+	for _, script := range []struct{ name, path string }{
+		{"DeployScript", conf.App.DeployScript},
+		{"RestartScript", conf.App.RestartScript},
+		{"MigrationScript", conf.App.MigrationScript},
+	} {
+		if script.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(script.path)
+		if err != nil {
+			add("App."+script.name, "%s", err)
+			continue
+		}
+		if _, err := template.New(script.path).Parse(string(data)); err != nil {
+			add("App."+script.name, "%s", err)
+		}
+	}
+
+	switch conf.HostKeyCheck {
+	case "", hostKeyStrict, hostKeyTOFU, hostKeyOff:
+	default:
+		add("HostKeyCheck", "unknown value %q, supported: %s, %s and %s", conf.HostKeyCheck, hostKeyStrict, hostKeyTOFU, hostKeyOff)
+	}
+	for _, d := range []struct{ name, val string }{
+		{"ConnectTimeout", conf.ConnectTimeout},
+		{"CommandTimeout", conf.CommandTimeout},
+		{"KeepAlive", conf.KeepAlive},
+	} {
+		if d.val == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d.val); err != nil {
+			add(d.name, "%s", err)
+		}
+	}
+
+	if rotate := conf.App.LogRotate; rotate != nil {
+		if rotate.MaxSize != "" {
+			if _, err := parseSize(rotate.MaxSize); err != nil {
+				add("App.LogRotate.MaxSize", "%s", err)
+			}
+		}
+		if rotate.Keep < 0 {
+			add("App.LogRotate.Keep", "should not be negative")
+		}
+	}
+
+	var sets []string
+	for name := range conf.ServerSets {
+		sets = append(sets, name)
+	}
+	sort.Strings(sets)
+	for _, name := range sets {
+		set := conf.ServerSets[name]
+		if set == nil {
+			continue
+		}
+		for i, member := range set.Sets {
+			path := fmt.Sprintf("ServerSets.%s.Sets.%d", name, i)
+			m := conf.ServerSets[member]
+			if _, ok := conf.Servers[member]; !ok && (m == nil || (m.Inventory == nil && len(m.Sets) == 0)) {
+				add(path, "server set %s doesn't exist", member)
+			} else if composesSet(conf.ServerSets, member, name, map[string]bool{}) {
+				add(path, "server set %s is composed of itself", name)
+			}
+		}
+		if set.Inventory == nil {
+			continue
+		}
+		path := "ServerSets." + name + ".Inventory"
+		inv := set.Inventory
+		switch {
+		case inv.Cmd != "" && inv.File != "":
+			add(path, "only one of Cmd and File could be specified")
+		case inv.Cmd == "" && inv.File == "":
+			add(path, "Cmd or File is required")
+		case inv.File != "":
+			if _, err := os.Stat(inv.File); err != nil {
+				add(path+".File", "%s", err)
+			}
+		}
+		if inv.TTL != "" {
+			if _, err := time.ParseDuration(inv.TTL); err != nil {
+				add(path+".TTL", "%s", err)
+			}
+		}
+	}
+
+	ids := map[string]string{}
+	for _, set := range sortedSetNames(conf.Servers) {
+		for i, s := range conf.Servers[set] {
+			path := fmt.Sprintf("Servers.%s.%d", set, i)
+			if s == nil {
+				add(path, "server is null")
+				continue
+			}
+			if s.Host == "" {
+				add(path, "Host is required")
+			}
+			if s.ID == "" {
+				continue
+			}
+			if dup, ok := ids[s.ID]; ok {
+				add(path+".ID", "duplicate server ID %s (%s)", s.ID, dup)
+			} else {
+				ids[s.ID] = path
+			}
+		}
+	}
+	return
+}
+
+// composesSet reports whether server set name is or is composed of target.
+func composesSet(sets map[string]*ServerSet, name, target string, visited map[string]bool) bool {
+	if name == target {
+		return true
+	}
+	if visited[name] || sets[name] == nil {
+		return false
+	}
+	visited[name] = true
+	for _, member := range sets[name].Sets {
+		if composesSet(sets, member, target, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// findGoPathFile returns path of the file (an import path) in GOPATH.
+func findGoPathFile(path string) string {
+	for _, gopath := range GoPaths {
+		src := filepath.Join(gopath, "src", path)
+		if _, err := os.Stat(src); err == nil {
+			return src
+		}
+	}
+	return ""
+}
+
+func sortedSetNames(servers map[string][]*Server) []string {
+	var names []string
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// locateConfigIssue finds the line of the deepest existing value on the
+// issue path, in the last config file containing it.
+func locateConfigIssue(files []configFile, issue configIssue) configIssue {
+	keys := strings.Split(issue.path, ".")
+	for n := len(keys); n > 0; n-- {
+		for i := len(files) - 1; i >= 0; i-- {
+			span, found, err := findJSONValue(files[i].data, keys[:n]...)
+			if err != nil || !found {
+				continue
+			}
+			issue.file = files[i].path
+			issue.line, issue.col = lineCol(files[i].data, span.start)
+			return issue
+		}
+	}
+	return issue
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("deploy.sh", "{{.SyncFiles}")
+	base := write("base.json", `{
+	"App": {"Name": "app", "ImportPath": "app"},
+	"Servers": {"prod": [{"ID": "a", "Host": "h1"}]}
+}`)
+	keys := write("keys.json", `{
+	// typos
+	"Extends": "base.json",
+	"App": {"Nmae": "app"},
+	"RollbackCount": "3",
+	"Servers": {"prod": [{"Hots": "h2"}]}
+}`)
+	settings := write("settings.json", `{
+	"Extends": "base.json",
+	"App": {
+		"DeployScript": "`+filepath.Join(dir, "deploy.sh")+`"
+	},
+	"HostKeyCheck": "yes",
+	"Servers": {
+		"prod": [{"Port": ":22"}],
+		"dev": [{"ID": "a", "Host": "h3"}]
+	}
+}`)
+
+	var got []string
+	for _, issue := range validateConfig([]string{keys}) {
+		got = append(got, issue.String())
+	}
+	want := []string{
+		keys + ":4:10: App.Nmae: unknown key, did you mean Name?",
+		keys + ":5:19: RollbackCount: integer expected, got string",
+		keys + ":6:24: Servers.prod.0.Hots: unknown key, did you mean Host?",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("validateConfig =\n%q\nwant\n%q", got, want)
+	}
+
+	got = nil
+	for _, issue := range validateConfig([]string{settings}) {
+		got = append(got, issue.String())
+	}
+	want = []string{
+		settings + ":4:19: App.DeployScript: template: " + filepath.Join(dir, "deploy.sh") + ":1: bad character U+007D '}'",
+		settings + ":6:18: HostKeyCheck: unknown value \"yes\", supported: strict, tofu and off",
+		base + ":3:30: Servers.prod.0.ID: duplicate server ID a (Servers.dev.0)",
+		settings + ":8:11: Servers.prod.1: Host is required",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("validateConfig =\n%q\nwant\n%q", got, want)
+	}
+}